@@ -0,0 +1,301 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/huaxr/rx/internal"
+)
+
+const (
+	MIMEJSON              = internal.MIMEJSON
+	MIMEHTML              = internal.MIMEHTML
+	MIMEXML               = internal.MIMEXML
+	MIMEXML2              = internal.MIMEXML2
+	MIMEPlain             = internal.MIMEPlain
+	MIMEPOSTForm          = internal.MIMEPOSTForm
+	MIMEMultipartPOSTForm = internal.MIMEMultipartPOSTForm
+	MIMEPROTOBUF          = internal.MIMEPROTOBUF
+	MIMEMSGPACK           = internal.MIMEMSGPACK
+	MIMEMSGPACK2          = internal.MIMEMSGPACK2
+	MIMEYAML              = internal.MIMEYAML
+)
+
+// Binder decode the request to dst.
+type Binder interface {
+	Name() string
+	Bind(req *http.Request, dst interface{}) error
+}
+
+// BindError is the failure of the binding, the request is aborted with
+// the Status: 400 for the malformed body, 415 for the unsupported type,
+// 422 for the validation.
+type BindError struct {
+	Status int16
+	Err    error
+}
+
+func (e *BindError) Error() string {
+	return e.Err.Error()
+}
+
+func bindErr(status int16, format string, val ...interface{}) *BindError {
+	return &BindError{Status: status, Err: fmt.Errorf(format, val...)}
+}
+
+var (
+	binderLock sync.RWMutex
+	binders    = map[string]Binder{
+		MIMEJSON:              jsonBinder{},
+		MIMEXML:               xmlBinder{},
+		MIMEXML2:              xmlBinder{},
+		MIMEPOSTForm:          formBinder{},
+		MIMEMultipartPOSTForm: multipartBinder{},
+	}
+)
+
+// RegisterBinder register the binder of the content type, e.g. a
+// msgpack or protobuf codec:
+// ctx.RegisterBinder(ctx.MIMEMSGPACK, ctx.UnmarshalBinder("msgpack", msgpack.Unmarshal))
+func RegisterBinder(contentType string, b Binder) {
+	binderLock.Lock()
+	binders[contentType] = b
+	binderLock.Unlock()
+}
+
+func getBinder(contentType string) (Binder, bool) {
+	binderLock.RLock()
+	defer binderLock.RUnlock()
+	b, ok := binders[contentType]
+	return b, ok
+}
+
+// UnmarshalBinder adapts the unmarshal func of a codec to the Binder.
+func UnmarshalBinder(name string, unmarshal func(data []byte, dst interface{}) error) Binder {
+	return unmarshalBinder{name: name, unmarshal: unmarshal}
+}
+
+type unmarshalBinder struct {
+	name      string
+	unmarshal func(data []byte, dst interface{}) error
+}
+
+func (b unmarshalBinder) Name() string {
+	return b.name
+}
+
+func (b unmarshalBinder) Bind(req *http.Request, dst interface{}) error {
+	bs, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return readBodyErr(err)
+	}
+	if len(bs) == 0 {
+		return bindErr(400, "empty body")
+	}
+	if err := b.unmarshal(bs, dst); err != nil {
+		return bindErr(400, "invalid %s body: %v", b.name, err)
+	}
+	return nil
+}
+
+type jsonBinder struct{}
+
+func (jsonBinder) Name() string {
+	return "json"
+}
+
+func (jsonBinder) Bind(req *http.Request, dst interface{}) error {
+	err := json.NewDecoder(req.Body).Decode(dst)
+	switch err {
+	case nil:
+		return nil
+	case io.EOF:
+		return bindErr(400, "empty body")
+	}
+	if be := readBodyErr(err); be.Status != 400 {
+		return be
+	}
+	return bindErr(400, "invalid json body: %v", err)
+}
+
+type xmlBinder struct{}
+
+func (xmlBinder) Name() string {
+	return "xml"
+}
+
+func (xmlBinder) Bind(req *http.Request, dst interface{}) error {
+	err := xml.NewDecoder(req.Body).Decode(dst)
+	switch err {
+	case nil:
+		return nil
+	case io.EOF:
+		return bindErr(400, "empty body")
+	}
+	if be := readBodyErr(err); be.Status != 400 {
+		return be
+	}
+	return bindErr(400, "invalid xml body: %v", err)
+}
+
+type formBinder struct{}
+
+func (formBinder) Name() string {
+	return "form"
+}
+
+func (formBinder) Bind(req *http.Request, dst interface{}) error {
+	if err := req.ParseForm(); err != nil {
+		return readBodyErr(err)
+	}
+	return mapForm(dst, req.PostForm, "form")
+}
+
+type multipartBinder struct{}
+
+func (multipartBinder) Name() string {
+	return "multipart"
+}
+
+func (multipartBinder) Bind(req *http.Request, dst interface{}) error {
+	if req.MultipartForm == nil {
+		if err := req.ParseMultipartForm(getConfig().Multipart.MaxMemory); err != nil {
+			return readBodyErr(err)
+		}
+	}
+	return mapForm(dst, req.MultipartForm.Value, "form")
+}
+
+// readBodyErr keep the status of the body limits.
+func readBodyErr(err error) *BindError {
+	if se, ok := err.(*SecurityError); ok {
+		return &BindError{Status: se.Status, Err: se}
+	}
+	return bindErr(400, "read body: %v", err)
+}
+
+// ParseBody bind the body with the binder of the Content-Type, JSON
+// is taken when the Content-Type is absent.
+func (rc *RequestContext) ParseBody(dst interface{}) error {
+	contentType := MIMEJSON
+	if ct := rc.request.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return rc.bindAbort(bindErr(415, "invalid content type %q", ct))
+		}
+		contentType = mt
+	}
+	b, ok := getBinder(contentType)
+	if !ok {
+		return rc.bindAbort(bindErr(415, "unsupported content type %q", contentType))
+	}
+	return rc.BindWith(dst, b)
+}
+
+func (rc *RequestContext) BindJSON(dst interface{}) error {
+	return rc.BindWith(dst, jsonBinder{})
+}
+
+func (rc *RequestContext) BindXML(dst interface{}) error {
+	return rc.BindWith(dst, xmlBinder{})
+}
+
+func (rc *RequestContext) BindForm(dst interface{}) error {
+	return rc.BindWith(dst, formBinder{})
+}
+
+func (rc *RequestContext) BindWith(dst interface{}, b Binder) error {
+	if _, ok := b.(multipartBinder); ok {
+		// parsed within the multipart limits, the files are kept.
+		if _, err := rc.MultipartForm(); err != nil {
+			return rc.bindAbort(err)
+		}
+	}
+	rc.request.Body = rc.Body()
+	if err := b.Bind(rc.request, dst); err != nil {
+		return rc.bindAbort(err)
+	}
+	return rc.validate(dst)
+}
+
+// BindQuery bind the query string with the query tags, e.g.
+// Tags []string `query:"tag"` for ?tag=a&tag=b.
+func (rc *RequestContext) BindQuery(dst interface{}) error {
+	return rc.bindSource(dst, formSource(rc.request.URL.Query()), "query")
+}
+
+// BindHeader bind the request headers with the header tags.
+func (rc *RequestContext) BindHeader(dst interface{}) error {
+	return rc.bindSource(dst, headerSource(rc.request.Header), "header")
+}
+
+// BindURI bind the route params with the uri tags, e.g.
+// ID int `uri:"id"` for the route "/user/:id".
+func (rc *RequestContext) BindURI(dst interface{}) error {
+	src := make(formSource, len(rc.params))
+	for _, p := range rc.params {
+		src[p.Key] = []string{p.Value}
+	}
+	return rc.bindSource(dst, src, "uri")
+}
+
+// bindSource bind the fields of the source, only they are validated, the
+// fields of the other sources may not be bound yet. the custom Validator
+// validates the whole struct by the Validate after the binds.
+func (rc *RequestContext) bindSource(dst interface{}, src valueSource, tag string) error {
+	if rc.bound == nil {
+		rc.bound = map[uintptr]bool{}
+	}
+	if err := mapSource(dst, src, tag, rc.bound); err != nil {
+		return rc.bindAbort(err)
+	}
+	tv, ok := validator.(tagValidator)
+	if !ok {
+		return nil
+	}
+	if err := tv.validateSource(dst, tag); err != nil {
+		return rc.bindAbort(&BindError{Status: 422, Err: err})
+	}
+	return nil
+}
+
+// Validate run the Validator on the whole dst, the request is aborted
+// with 422 on failure.
+func (rc *RequestContext) Validate(dst interface{}) error {
+	return rc.validate(dst)
+}
+
+// validate run the Validator on the bound dst.
+func (rc *RequestContext) validate(dst interface{}) error {
+	if validator == nil {
+		return nil
+	}
+	if err := validator.Validate(dst); err != nil {
+		return rc.bindAbort(&BindError{Status: 422, Err: err})
+	}
+	return nil
+}
+
+// bindAbort abort the request with the status of the binding error.
+func (rc *RequestContext) bindAbort(err error) error {
+	be, ok := err.(*BindError)
+	if !ok {
+		be = &BindError{Status: 400, Err: err}
+	}
+	if ve, ok := be.Err.(ValidationErrors); ok {
+		rc.setAbort(be.Status, map[string]interface{}{"message": "validation failed", "errors": ve})
+		return be
+	}
+	rc.setAbort(be.Status, be.Error())
+	return be
+}
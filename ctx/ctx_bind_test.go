@@ -0,0 +1,199 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bindUser struct {
+	Name string   `json:"name" xml:"name" form:"name"`
+	Age  int      `json:"age" xml:"age" form:"age"`
+	Tags []string `json:"tags" xml:"tags" form:"tags"`
+}
+
+func init() {
+	Register("post", "/bind/body", func(c ReqCxtI) {
+		var u bindUser
+		if err := c.ParseBody(&u); err != nil {
+			return
+		}
+		c.JSON(200, fmt.Sprintf("%s:%d:%s", u.Name, u.Age, strings.Join(u.Tags, ",")))
+	})
+}
+
+func post(contentType, body string) string {
+	return "POST /bind/body HTTP/1.1\r\nHost: x\r\nContent-Type: " + contentType +
+		fmt.Sprintf("\r\nContent-Length: %d\r\n\r\n", len(body)) + body
+}
+
+func TestParseBody(t *testing.T) {
+	addr := serve(t)
+	for _, tc := range []struct {
+		contentType, body string
+		status            int
+		want              string
+	}{
+		{"application/json; charset=utf-8", `{"name":"rx","age":3,"tags":["a","b"]}`, 200, `"rx:3:a,b"`},
+		{"application/xml", `<bindUser><name>rx</name><age>3</age><tags>a</tags></bindUser>`, 200, `"rx:3:a"`},
+		{"application/x-www-form-urlencoded", `name=rx&age=3&tags=a&tags=b`, 200, `"rx:3:a,b"`},
+		{"application/json", `{"name":`, 400, ""},
+		{"application/json", ``, 400, ""},
+		{"application/x-www-form-urlencoded", `age=x`, 400, ""},
+		{"application/yaml", `name: rx`, 415, ""},
+	} {
+		rsp := roundTrip(t, addr, post(tc.contentType, tc.body))
+		body := readBody(t, rsp)
+		if rsp.StatusCode != tc.status {
+			t.Fatalf("%s %q: status %d %s", tc.contentType, tc.body, rsp.StatusCode, body)
+		}
+		if tc.want != "" && body != tc.want {
+			t.Fatalf("%s: body %s", tc.contentType, body)
+		}
+	}
+}
+
+type validUser struct {
+	Name    string `json:"name" rx:"required,min=2,max=8"`
+	Email   string `json:"email" rx:"omitempty,email"`
+	Role    string `json:"role" rx:"oneof=admin user"`
+	Age     *int   `json:"age" rx:"min=18"`
+	Friends []struct {
+		Name string `json:"name" rx:"required"`
+	} `json:"friends"`
+}
+
+func TestValidate(t *testing.T) {
+	var u validUser
+	err := tagValidator{}.Validate(&u)
+	ve, ok := err.(ValidationErrors)
+	if !ok || len(ve) != 2 || ve[0].Path != "name" || ve[1].Path != "role" {
+		t.Fatalf("zero value: %v", err)
+	}
+
+	age := 17
+	u = validUser{Name: "rx", Email: "bad", Role: "admin", Age: &age}
+	u.Friends = append(u.Friends, struct {
+		Name string `json:"name" rx:"required"`
+	}{})
+	ve, _ = tagValidator{}.Validate(&u).(ValidationErrors)
+	var paths []string
+	for _, fe := range ve {
+		paths = append(paths, fe.Path+":"+fe.Rule)
+	}
+	if got := strings.Join(paths, ","); got != "email:email,age:min,friends[0].name:required" {
+		t.Fatalf("errors %s", got)
+	}
+
+	RegisterRule("even", func(v reflect.Value, _ string) bool { return v.Int()%2 == 0 })
+	var e struct {
+		N int `json:"n" rx:"even"`
+	}
+	e.N = 3
+	if err := (tagValidator{}).Validate(&e); err == nil {
+		t.Fatal("custom rule not applied")
+	}
+}
+
+func TestParseBodyValidate(t *testing.T) {
+	Register("post", "/bind/valid", func(c ReqCxtI) {
+		var u validUser
+		if err := c.ParseBody(&u); err != nil {
+			return
+		}
+		c.JSON(200, u.Name)
+	})
+	addr := serve(t)
+	rsp := roundTrip(t, addr, strings.Replace(post("application/json", `{"name":"r","role":"user"}`), "/bind/body", "/bind/valid", 1))
+	body := readBody(t, rsp)
+	if rsp.StatusCode != 422 || !strings.Contains(body, `"path":"name"`) || !strings.Contains(body, `"rule":"min"`) {
+		t.Fatalf("status %d %s", rsp.StatusCode, body)
+	}
+}
+
+type page struct {
+	Page int `query:"page" default:"1"`
+	Size int `query:"size" default:"20"`
+}
+
+type searchQuery struct {
+	page
+	Tags   []string       `query:"tag"`
+	Since  *time.Time     `query:"since"`
+	Until  time.Time      `query:"until" time_format:"unix"`
+	Within time.Duration  `query:"within"`
+	Limit  *int           `query:"limit"`
+	Sort   string         `query:"sort" default:"desc" rx:"oneof=asc desc"`
+	Token  string         `header:"X-Token"`
+	ID     int            `uri:"id"`
+	Extra  map[string]int `query:"-"`
+}
+
+func TestBindSource(t *testing.T) {
+	Register("get", "/bind/user/:id/search", func(c ReqCxtI) {
+		var q searchQuery
+		if c.BindURI(&q) != nil || c.BindQuery(&q) != nil || c.BindHeader(&q) != nil {
+			return
+		}
+		c.JSON(200, fmt.Sprintf("%d %d %d %v %s %d %s %v %s %s",
+			q.ID, q.Page, q.Size, q.Tags, q.Since.UTC().Format(time.RFC3339), q.Until.Unix(),
+			q.Within, q.Limit == nil, q.Sort, q.Token))
+	})
+	addr := serve(t)
+	rsp := roundTrip(t, addr, "GET /bind/user/7/search?tag=a&tag=b&size=5&since=2021-01-02T03:04:05Z&until=100&within=1m HTTP/1.1\r\nHost: x\r\nX-Token: abc\r\n\r\n")
+	body := readBody(t, rsp)
+	if want := `"7 1 5 [a b] 2021-01-02T03:04:05Z 100 1m0s true desc abc"`; body != want {
+		t.Fatalf("status %d body %s", rsp.StatusCode, body)
+	}
+
+	rsp = roundTrip(t, addr, "GET /bind/user/7/search?sort=up HTTP/1.1\r\nHost: x\r\n\r\n")
+	if body := readBody(t, rsp); rsp.StatusCode != 422 {
+		t.Fatalf("status %d body %s", rsp.StatusCode, body)
+	}
+	rsp = roundTrip(t, addr, "GET /bind/user/x/search HTTP/1.1\r\nHost: x\r\n\r\n")
+	if body := readBody(t, rsp); rsp.StatusCode != 400 {
+		t.Fatalf("status %d body %s", rsp.StatusCode, body)
+	}
+}
+
+type sourceQuery struct {
+	ID    int    `uri:"id" rx:"min=1"`
+	Token string `header:"X-Token" rx:"required"`
+	Count int    `query:"count" default:"5"`
+	Name  string `default:"anon"`
+}
+
+func TestBindSources(t *testing.T) {
+	Register("get", "/bind/source/:id", func(c ReqCxtI) {
+		var q sourceQuery
+		// the header field required is validated by the BindHeader.
+		if c.BindURI(&q) != nil || c.BindQuery(&q) != nil || c.BindHeader(&q) != nil {
+			return
+		}
+		c.JSON(200, fmt.Sprintf("%d %s %d %s", q.ID, q.Token, q.Count, q.Name))
+	})
+	addr := serve(t)
+	for _, tc := range []struct {
+		req    string
+		status int
+		want   string
+	}{
+		// the explicit zero is kept, the query key doesn't bind the
+		// header field, the untagged field falls back to its name.
+		{"GET /bind/source/7?count=0&Token=q&Name=x HTTP/1.1\r\nHost: x\r\nX-Token: abc\r\n\r\n", 200, `"7 abc 0 x"`},
+		{"GET /bind/source/7 HTTP/1.1\r\nHost: x\r\nX-Token: abc\r\n\r\n", 200, `"7 abc 5 anon"`},
+		{"GET /bind/source/7?Token=q HTTP/1.1\r\nHost: x\r\n\r\n", 422, ""},
+		{"GET /bind/source/0 HTTP/1.1\r\nHost: x\r\nX-Token: abc\r\n\r\n", 422, ""},
+	} {
+		rsp := roundTrip(t, addr, tc.req)
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || (tc.want != "" && body != tc.want) {
+			t.Fatalf("%q: %d %s", tc.req, rsp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressPolicy compresses the responses with gzip or deflate as the
+// Accept-Encoding of the client prefers, e.g.
+// c.RegisterStrategy(&ctx.StrategyContext{Compress: &ctx.CompressPolicy{}})
+type CompressPolicy struct {
+	// MinLength the shorter bodies are sent as they are, default 1KB.
+	MinLength int
+	// Level of the compression from 1 to 9, default 6.
+	Level int
+	// SkipTypes the MIME types already compressed besides the images,
+	// videos, audios and archives, "type/*" skips the whole type.
+	SkipTypes []string
+}
+
+const (
+	codingGzip    = "gzip"
+	codingDeflate = "deflate"
+)
+
+func (p *CompressPolicy) minLength() int {
+	if p.MinLength <= 0 {
+		return 1 << 10
+	}
+	return p.MinLength
+}
+
+func (p *CompressPolicy) level() int {
+	if p.Level < flate.BestSpeed || p.Level > flate.BestCompression {
+		return 6
+	}
+	return p.Level
+}
+
+// compressedTypes are not worth compressing again.
+var compressedTypes = []string{
+	"image/*", "video/*", "audio/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed",
+	"application/pdf", "application/octet-stream",
+}
+
+// compressible report whether the content type is worth compressing,
+// the svg is compressible text.
+func (p *CompressPolicy) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	if mt == "image/svg+xml" {
+		return true
+	}
+	for _, types := range [][]string{compressedTypes, p.SkipTypes} {
+		for _, t := range types {
+			if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// acceptCoding return the coding of the Accept-Encoding of the highest q,
+// gzip wins the tie. "" when neither is acceptable.
+func acceptCoding(accept string) string {
+	q := map[string]float64{}
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		v := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				f, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					f = 0
+				}
+				v = f
+			}
+		}
+		q[coding] = v
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{codingGzip, codingDeflate} {
+		v, ok := q[coding]
+		if !ok {
+			if coding == codingGzip {
+				v, ok = q["x-gzip"]
+			}
+			if !ok {
+				v = q["*"]
+			}
+		}
+		if v > bestQ {
+			best, bestQ = coding, v
+		}
+	}
+	return best
+}
+
+// the writers pooled by the level, the index is the level.
+var (
+	gzipPools [flate.BestCompression + 1]sync.Pool
+	zlibPools [flate.BestCompression + 1]sync.Pool
+)
+
+// compressor is a pooled gzip or deflate writer.
+type compressor struct {
+	io.WriteCloser
+	release func()
+}
+
+// newCompressor return the pooled writer of the coding writing to w, it's
+// released once closed.
+func newCompressor(coding string, level int, w io.Writer) *compressor {
+	if coding == codingGzip {
+		pool := &gzipPools[level]
+		zw, _ := pool.Get().(*gzip.Writer)
+		if zw == nil {
+			zw, _ = gzip.NewWriterLevel(w, level)
+		} else {
+			zw.Reset(w)
+		}
+		return &compressor{WriteCloser: zw, release: func() { pool.Put(zw) }}
+	}
+	// the deflate coding is the zlib format.
+	pool := &zlibPools[level]
+	zw, _ := pool.Get().(*zlib.Writer)
+	if zw == nil {
+		zw, _ = zlib.NewWriterLevel(w, level)
+	} else {
+		zw.Reset(w)
+	}
+	return &compressor{WriteCloser: zw, release: func() { pool.Put(zw) }}
+}
+
+// Flush compress the pending bytes, the stream sends them as a chunk.
+func (c *compressor) Flush() error {
+	return c.WriteCloser.(Flusher).Flush()
+}
+
+func (c *compressor) Close() error {
+	err := c.WriteCloser.Close()
+	c.release()
+	return err
+}
+
+// compressCoding decide the coding of the response, "" to send it as it
+// is. the Vary is added once the response is compressible.
+func (rc *RequestContext) compressCoding(length int) string {
+	if rc.StrategyContext == nil || rc.Compress == nil || rc.request == nil {
+		return ""
+	}
+	p := rc.Compress
+	if !bodyAllowed(int(rc.status)) || rc.request.Method == http.MethodHead ||
+		rc.rspHeaders.Get("Content-Encoding") != "" || !p.compressible(rc.rspHeaders.Get("Content-Type")) {
+		return ""
+	}
+	// the unknown length of the stream is -1.
+	if length >= 0 && length < p.minLength() {
+		return ""
+	}
+	addVary(rc.rspHeaders, "Accept-Encoding")
+	coding := acceptCoding(rc.request.Header.Get("Accept-Encoding"))
+	if coding == "" {
+		return ""
+	}
+	rc.rspHeaders.Set("Content-Encoding", coding)
+	// the strong validator is of the identity body.
+	if etag := rc.rspHeaders.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		rc.rspHeaders.Set("ETag", "W/"+etag)
+	}
+	return coding
+}
+
+// addVary add the header to the Vary unless it's listed.
+func addVary(h http.Header, header string) {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" || strings.EqualFold(name, header) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", header)
+}
+
+// compressBody compress the buffered body before it's serialized.
+func (rc *RequestContext) compressBody() {
+	coding := rc.compressCoding(len(rc.rspBody))
+	if coding == "" {
+		return
+	}
+	var buf bytes.Buffer
+	zw := newCompressor(coding, rc.Compress.level(), &buf)
+	_, _ = zw.Write(rc.rspBody)
+	_ = zw.Close()
+	rc.rspBody = buf.Bytes()
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var compressText = strings.Repeat("rx compress ", 200)
+
+func init() {
+	compressed := func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Compress: &CompressPolicy{MinLength: 64}})
+	}
+	Register("get", "/compress/text", compressed, func(c ReqCxtI) {
+		c.SetHeader("ETag", `"v1"`)
+		c.String(200, compressText)
+	})
+	Register("get", "/compress/small", compressed, func(c ReqCxtI) {
+		c.String(200, "small")
+	})
+	Register("get", "/compress/png", compressed, func(c ReqCxtI) {
+		c.Data(200, "image/png", []byte(compressText))
+	})
+}
+
+func TestAcceptCoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                      "",
+		"gzip":                  codingGzip,
+		"deflate, gzip":         codingGzip,
+		"gzip;q=0.5, deflate":   codingDeflate,
+		"gzip;q=0, *":           codingDeflate,
+		"*;q=0":                 "",
+		"identity":              "",
+		"br, x-gzip":            codingGzip,
+		"GZIP;Q=0.1, br;q=1":    codingGzip,
+		"deflate;q=0, gzip;q=0": "",
+	} {
+		if got := acceptCoding(accept); got != want {
+			t.Fatalf("%q: %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func decode(t *testing.T, coding string, r io.Reader) string {
+	var err error
+	switch coding {
+	case codingGzip:
+		r, err = gzip.NewReader(r)
+	case codingDeflate:
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompress(t *testing.T) {
+	addr := serve(t)
+	for _, tc := range []struct {
+		path, accept, coding, vary string
+	}{
+		{"/compress/text", "gzip, deflate", codingGzip, "Accept-Encoding"},
+		{"/compress/text", "gzip;q=0.1, deflate", codingDeflate, "Accept-Encoding"},
+		{"/compress/text", "identity", "", "Accept-Encoding"},
+		{"/compress/small", "gzip", "", ""},
+		{"/compress/png", "gzip", "", ""},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+addr+tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		// the transport keeps the body encoded with the Accept-Encoding set.
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rsp.Header.Get("Content-Encoding"); got != tc.coding || rsp.Header.Get("Vary") != tc.vary {
+			t.Fatalf("%s %q: Content-Encoding %q Vary %q", tc.path, tc.accept, got, rsp.Header.Get("Vary"))
+		}
+		body := decode(t, tc.coding, rsp.Body)
+		rsp.Body.Close()
+		if tc.path == "/compress/text" {
+			if body != compressText {
+				t.Fatalf("%q: body %q", tc.accept, body)
+			}
+			if etag := rsp.Header.Get("ETag"); (tc.coding != "") != (etag == `W/"v1"`) {
+				t.Fatalf("%q: ETag %q", tc.accept, etag)
+			}
+			if tc.coding != "" && rsp.ContentLength >= int64(len(compressText)) {
+				t.Fatalf("%q: length %d", tc.accept, rsp.ContentLength)
+			}
+		}
+	}
+
+	lc := &loopConn{closed: make(chan struct{})}
+	ec := NewEPollConn(lc)
+	ec.Serve([]byte("GET /compress/text HTTP/1.1\r\nHost: rx\r\nAccept-Encoding: gzip\r\nConnection: close\r\n\r\n"))
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.Header.Get("Content-Encoding") != codingGzip || decode(t, codingGzip, rsp.Body) != compressText {
+		t.Fatalf("epoll: %v", rsp.Header)
+	}
+}
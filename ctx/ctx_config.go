@@ -0,0 +1,112 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Config of the engine connections, the zero fields take the default.
+type Config struct {
+	// MaxHeaderBytes limits the request line and headers, default 1MB.
+	MaxHeaderBytes int
+	// MaxBodyBytes limits the request body, default 32MB, -1 no limit.
+	MaxBodyBytes int64
+	// ReadHeaderTimeout the time to read the request line and headers,
+	// default 10s.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout the time to read the whole request including the body,
+	// default 60s.
+	ReadTimeout time.Duration
+	// WriteTimeout the time to write each chunk of the streamed
+	// responses, the stalled client is disconnected, default 60s.
+	WriteTimeout time.Duration
+	// SSEHeartbeat the interval of the comments keeping the idle event
+	// streams, default 15s.
+	SSEHeartbeat time.Duration
+
+	// IdleTimeout the time a persistent connection waits for the next
+	// request, default 60s.
+	IdleTimeout time.Duration
+	// MaxRequestsPerConn closes the connection after serving the count
+	// of requests, 0 means no limit.
+	MaxRequestsPerConn int
+	// DisableKeepAlive closes the connection after each request.
+	DisableKeepAlive bool
+	// MaxPipeline the outstanding pipelined requests of a connection,
+	// default 16.
+	MaxPipeline int
+
+	// ProxyProtocol requires the HAProxy PROXY protocol v1 or v2 header
+	// at the head of every connection, the source address of the header
+	// is taken as the remote address of the requests.
+	ProxyProtocol bool
+
+	// Multipart limits the multipart forms.
+	Multipart MultipartConfig
+	// Decompress the request bodies with the Content-Encoding.
+	Decompress DecompressConfig
+}
+
+var defaultConfig = Config{
+	MaxHeaderBytes:    1 << 20,
+	MaxBodyBytes:      32 << 20,
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       60 * time.Second,
+	WriteTimeout:      60 * time.Second,
+	SSEHeartbeat:      15 * time.Second,
+	IdleTimeout:       60 * time.Second,
+	MaxPipeline:       16,
+	Multipart:         MultipartConfig{MaxMemory: 32 << 20},
+	Decompress:        DecompressConfig{MaxSize: 32 << 20},
+}
+
+var config atomic.Value
+
+func init() {
+	config.Store(&defaultConfig)
+}
+
+// getConfig return the current config, the connections read it
+// concurrently with SetConfig.
+func getConfig() *Config {
+	return config.Load().(*Config)
+}
+
+// SetConfig set the config of the engine connections.
+func SetConfig(c Config) {
+	if c.MaxHeaderBytes <= 0 {
+		c.MaxHeaderBytes = defaultConfig.MaxHeaderBytes
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = defaultConfig.MaxBodyBytes
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		c.ReadHeaderTimeout = defaultConfig.ReadHeaderTimeout
+	}
+	if c.ReadTimeout <= 0 {
+		c.ReadTimeout = defaultConfig.ReadTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultConfig.WriteTimeout
+	}
+	if c.SSEHeartbeat <= 0 {
+		c.SSEHeartbeat = defaultConfig.SSEHeartbeat
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultConfig.IdleTimeout
+	}
+	if c.MaxPipeline <= 0 {
+		c.MaxPipeline = defaultConfig.MaxPipeline
+	}
+	if c.Multipart.MaxMemory <= 0 {
+		c.Multipart.MaxMemory = defaultConfig.Multipart.MaxMemory
+	}
+	if c.Decompress.MaxSize == 0 {
+		c.Decompress.MaxSize = defaultConfig.Decompress.MaxSize
+	}
+	config.Store(&c)
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/huaxr/rx/internal"
+)
+
+var (
+	errHeaderTooLarge = errors.New("request header too large")
+	errBodyTooLarge   = errors.New("request body too large")
+	errIncomplete     = errors.New("request incomplete")
+)
+
+// connReader limits the bytes read from the connection while the
+// request headers are parsed.
+type connReader struct {
+	conn   net.Conn
+	remain int64
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if cr.remain <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	n, err := cr.conn.Read(p)
+	cr.remain -= int64(n)
+	return n, err
+}
+
+// stdConn is the connection of the std engine. http.ReadRequest frames
+// the message: the headers are parsed first, then the body is streamed
+// from the connection honouring the Content-Length or the chunked
+// Transfer-Encoding, so that the handlers read exactly one request.
+type stdConn struct {
+	net.Conn
+	cr *connReader
+	br *bufio.Reader
+
+	// served the count of requests read from the connection.
+	served int
+
+	// last is the done of the last request, slots limits the
+	// outstanding pipelined requests.
+	last  <-chan struct{}
+	slots chan struct{}
+
+	// remote the source address of the PROXY protocol header.
+	remote net.Addr
+}
+
+func newStdConn(conn net.Conn) *stdConn {
+	cr := &connReader{conn: conn}
+	return &stdConn{
+		Conn: conn,
+		cr:   cr,
+		br:   bufio.NewReader(cr),
+	}
+}
+
+func (sc *stdConn) RemoteAddr() net.Addr {
+	if sc.remote != nil {
+		return sc.remote
+	}
+	return sc.Conn.RemoteAddr()
+}
+
+// maxProxyHeader the max length of the PROXY protocol v2 header.
+const maxProxyHeader = 16 + math.MaxUint16
+
+// readProxy read the PROXY protocol header at the head of the connection.
+func (sc *stdConn) readProxy() error {
+	_ = sc.SetReadDeadline(time.Now().Add(getConfig().ReadHeaderTimeout))
+	sc.cr.remain = maxProxyHeader
+	for n := 1; ; {
+		b, err := sc.br.Peek(n)
+		if err != nil {
+			return err
+		}
+		// the v2 header may not fit the buffer, it's read whole by the
+		// length of its prefix.
+		if size := internal.ProxyV2Len(b); size > 0 {
+			b = make([]byte, size)
+			if _, err := io.ReadFull(sc.br, b); err != nil {
+				return err
+			}
+			src, _, err := internal.ParseProxyHeader(b)
+			if err != nil {
+				return err
+			}
+			sc.remote = src
+			return nil
+		}
+		src, size, err := internal.ParseProxyHeader(b)
+		if err == internal.ErrProxyIncomplete {
+			if n++; n < sc.br.Buffered() {
+				n = sc.br.Buffered()
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, _ = sc.br.Discard(size)
+		sc.remote = src
+		return nil
+	}
+}
+
+// readRequest read the headers of the next request, the body is left
+// on the connection for the handlers to stream.
+func (sc *stdConn) readRequest() (*http.Request, error) {
+	config := getConfig()
+	start := time.Now()
+	_ = sc.SetReadDeadline(start.Add(config.ReadHeaderTimeout))
+	// the bufio.Reader reads ahead a buffer over the headers.
+	sc.cr.remain = int64(config.MaxHeaderBytes) + 4096
+
+	req, err := http.ReadRequest(sc.br)
+	if err != nil {
+		if sc.cr.remain <= 0 {
+			return nil, errHeaderTooLarge
+		}
+		return nil, err
+	}
+	sc.cr.remain = math.MaxInt64
+	_ = sc.SetReadDeadline(start.Add(config.ReadTimeout))
+	req.RemoteAddr = sc.RemoteAddr().String()
+	sc.served++
+
+	if config.MaxBodyBytes > 0 {
+		if req.ContentLength > config.MaxBodyBytes {
+			return req, errBodyTooLarge
+		}
+		req.Body = &limitedBody{ReadCloser: req.Body, remain: config.MaxBodyBytes}
+	}
+	return req, nil
+}
+
+// keepAlive report whether the connection persists after the request,
+// HTTP/1.1 persists unless "Connection: close", HTTP/1.0 only with
+// "Connection: keep-alive", which http.ReadRequest reflects in Close.
+func (sc *stdConn) keepAlive(req *http.Request) bool {
+	config := getConfig()
+	if config.DisableKeepAlive || req.Close {
+		return false
+	}
+	return config.MaxRequestsPerConn <= 0 || sc.served < config.MaxRequestsPerConn
+}
+
+// maxDrainBytes the unread body discarded to reuse the connection,
+// the connection of a larger body is closed.
+const maxDrainBytes = 256 << 10
+
+// drain discard the body the handlers left unread, so that the next
+// request starts at the message boundary.
+func (sc *stdConn) drain(req *http.Request) bool {
+	n, err := io.CopyN(ioutil.Discard, req.Body, maxDrainBytes+1)
+	return n <= maxDrainBytes && err == io.EOF
+}
+
+// waitIdle wait for the next request of the persistent connection.
+func (sc *stdConn) waitIdle() bool {
+	_ = sc.SetReadDeadline(time.Now().Add(getConfig().IdleTimeout))
+	_, err := sc.br.Peek(1)
+	return err == nil
+}
+
+// park wait for the next request off the workers and dispatch it.
+func (sc *stdConn) park(dispatch func(net.Conn)) {
+	if !sc.waitIdle() {
+		_ = sc.Close()
+		return
+	}
+	dispatch(sc)
+}
+
+// pipelined report whether the next request has been sent before the
+// response of the request, it's read ahead when the request has no body.
+func (sc *stdConn) pipelined(req *http.Request) bool {
+	return req.ContentLength == 0 && sc.br.Buffered() > 0
+}
+
+func (sc *stdConn) acquire() {
+	if sc.slots == nil {
+		sc.slots = make(chan struct{}, getConfig().MaxPipeline)
+	}
+	sc.slots <- struct{}{}
+}
+
+func (sc *stdConn) release() {
+	<-sc.slots
+}
+
+// wait for the responses of the outstanding requests, the responses are
+// written in order so the last one is written at the end.
+func (sc *stdConn) wait() {
+	if sc.last != nil {
+		<-sc.last
+	}
+}
+
+// readErrStatus return the status responded to the read error, 0 closes
+// the connection silently.
+func readErrStatus(err error) (int16, string) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, ""
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 0, ""
+	}
+	switch err {
+	case errHeaderTooLarge:
+		return 431, err.Error()
+	case errBodyTooLarge:
+		return 413, err.Error()
+	}
+	return 400, "malformed request: " + err.Error()
+}
@@ -0,0 +1,582 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	DisableLog()
+	Register("post", "/framing/echo", echo)
+	Register("get", "/keepalive/empty", func(c ReqCxtI) {})
+}
+
+// serve start the std engine on a random port.
+func serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go WrapStd(c, "http")
+		}
+	}()
+	return l.Addr().String()
+}
+
+// roundTrip write the raw request in pieces and read the response.
+func roundTrip(t *testing.T, addr string, pieces ...string) *http.Response {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	for _, p := range pieces {
+		if _, err := c.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func readBody(t *testing.T, rsp *http.Response) string {
+	defer rsp.Body.Close()
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func echo(c ReqCxtI) {
+	b, err := ioutil.ReadAll(c.Body())
+	if err != nil {
+		c.Abort(413, err.Error())
+		return
+	}
+	c.JSON(200, string(b))
+}
+
+func TestReadContentLengthSegments(t *testing.T) {
+	addr := serve(t)
+	body := strings.Repeat("x", 100)
+	rsp := roundTrip(t, addr,
+		"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nContent-Length: 100\r\n\r\n",
+		body[:7], body[7:40], body[40:])
+	if got := readBody(t, rsp); got != `"`+body+`"` {
+		t.Fatalf("body truncated: %s", got)
+	}
+}
+
+func TestReadChunked(t *testing.T) {
+	addr := serve(t)
+	rsp := roundTrip(t, addr,
+		"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"5\r\nhello\r\n", "6\r\n world\r\n", "0\r\n\r\n")
+	if got := readBody(t, rsp); got != `"hello world"` {
+		t.Fatalf("chunked body: %s", got)
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	SetConfig(Config{MaxHeaderBytes: 1 << 10, MaxBodyBytes: 16})
+	defer SetConfig(defaultConfig)
+	addr := serve(t)
+
+	rsp := roundTrip(t, addr, "GET /framing/echo HTTP/1.1\r\nHost: rx\r\nX-Big: "+strings.Repeat("a", 8<<10)+"\r\n\r\n")
+	if rsp.StatusCode != 431 {
+		t.Fatalf("header limit status %d", rsp.StatusCode)
+	}
+	rsp = roundTrip(t, addr, "POST /framing/echo HTTP/1.1\r\nHost: rx\r\nContent-Length: 17\r\n\r\n", strings.Repeat("a", 17))
+	if rsp.StatusCode != 413 {
+		t.Fatalf("content-length limit status %d", rsp.StatusCode)
+	}
+	rsp = roundTrip(t, addr, "POST /framing/echo HTTP/1.1\r\nHost: rx\r\nTransfer-Encoding: chunked\r\n\r\n", "11\r\n"+strings.Repeat("a", 17)+"\r\n0\r\n\r\n")
+	if rsp.StatusCode != 413 {
+		t.Fatalf("chunked limit status %d", rsp.StatusCode)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i, req := range []string{
+		"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nContent-Length: 1\r\n\r\na",
+		"GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n",
+		"POST /framing/echo HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: 1\r\n\r\nb",
+		"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nConnection: close\r\nContent-Length: 1\r\n\r\nc",
+	} {
+		if _, err := c.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		readBody(t, rsp)
+		// the close token is reflected in rsp.Close
+		want := []string{"", "", "keep-alive", ""}[i]
+		if got := rsp.Header.Get("Connection"); got != want || rsp.Close != (i == 3) {
+			t.Fatalf("request %d Connection %q close %v", i, got, rsp.Close)
+		}
+	}
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	SetConfig(Config{MaxRequestsPerConn: 2})
+	defer SetConfig(defaultConfig)
+	addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		readBody(t, rsp)
+		// the last request allowed announces the close.
+		if rsp.Close != (i == 1) {
+			t.Fatalf("request %d close %v", i, rsp.Close)
+		}
+	}
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	SetConfig(Config{IdleTimeout: 50 * time.Millisecond})
+	defer SetConfig(defaultConfig)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the parked connection is dispatched back on the next request.
+	dispatched := make(chan struct{}, 4)
+	var dispatch func(net.Conn)
+	dispatch = func(c net.Conn) {
+		dispatched <- struct{}{}
+		go ServeStd(c, "http", dispatch)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeStd(c, "http", dispatch)
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		readBody(t, rsp)
+		// within the IdleTimeout the connection is kept.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(dispatched) != 1 {
+		t.Fatalf("dispatched %d", len(dispatched))
+	}
+	start := time.Now()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("idle connection not closed")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("idle connection closed after %v", elapsed)
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	Register("get", "/pipeline/slow", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Async: true})
+	}, func(c ReqCxtI) {
+		time.Sleep(20 * time.Millisecond)
+		c.JSON(200, "slow")
+	})
+	Register("get", "/pipeline/fast", func(c ReqCxtI) {
+		c.JSON(200, "fast")
+	})
+	addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Write([]byte("GET /pipeline/slow HTTP/1.1\r\nHost: rx\r\n\r\n" +
+		"GET /pipeline/fast HTTP/1.1\r\nHost: rx\r\n\r\n" +
+		"GET /pipeline/slow HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	for i, want := range []string{`"slow"`, `"fast"`, `"slow"`} {
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if got := readBody(t, rsp); got != want {
+			t.Fatalf("response %d %s, want %s", i, got, want)
+		}
+	}
+}
+
+// loopConn records the responses queued by the EPollConn.
+type loopConn struct {
+	mu     sync.Mutex
+	out    bytes.Buffer
+	closed chan struct{}
+}
+
+func (l *loopConn) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Write(b)
+}
+
+func (l *loopConn) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *loopConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func TestEPollPipeline(t *testing.T) {
+	lc := &loopConn{closed: make(chan struct{})}
+	ec := NewEPollConn(lc)
+	raw := "POST /framing/echo HTTP/1.1\r\nHost: rx\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /pipeline/slow HTTP/1.1\r\nHost: rx\r\n\r\n" +
+		"GET /pipeline/fast HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"
+	// split inside the body and the headers.
+	for _, piece := range []string{raw[:50], raw[50:70], raw[70:]} {
+		ec.Serve([]byte(piece))
+	}
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	br := bufio.NewReader(&lc.out)
+	for i, want := range []string{`"hello"`, `"slow"`, `"fast"`} {
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if got := readBody(t, rsp); got != want {
+			t.Fatalf("response %d %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestEPollFraming(t *testing.T) {
+	SetConfig(Config{MaxBodyBytes: 16})
+	defer SetConfig(defaultConfig)
+	for _, tc := range []struct {
+		raw    string
+		status int
+		want   string
+	}{
+		{"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nContent-Length: 5\r\n\r\nhello", 200, `"hello"`},
+		{"POST /framing/echo HTTP/1.1\nHost: rx\nContent-Length: 2\n\nhi", 200, `"hi"`},
+		{"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n", 200, `"hello world"`},
+		{"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"9\r\n123456789\r\n9\r\n123456789\r\n0\r\n\r\n", 413, ""},
+		{"POST /framing/echo HTTP/1.1\r\nHost: rx\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", 400, ""},
+	} {
+		lc := &loopConn{closed: make(chan struct{})}
+		ec := NewEPollConn(lc)
+		// fed a byte a time, the progress is kept between the reads.
+		for i := 0; i < len(tc.raw); i++ {
+			ec.Serve([]byte{tc.raw[i]})
+		}
+		ec.Serve([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+		<-lc.closed
+		rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || (tc.want != "" && body != tc.want) {
+			t.Fatalf("%q: %d %s", tc.raw, rsp.StatusCode, body)
+		}
+	}
+}
+
+// runnerConn runs the work queued for the loop on the loop goroutine.
+type runnerConn struct {
+	*loopConn
+	tasks  chan func()
+	inLoop int32
+}
+
+func (r *runnerConn) Loop(f func()) {
+	r.tasks <- f
+}
+
+func (r *runnerConn) run() {
+	for f := range r.tasks {
+		atomic.StoreInt32(&r.inLoop, 1)
+		f()
+		atomic.StoreInt32(&r.inLoop, 0)
+	}
+}
+
+func TestEPollLoopRunner(t *testing.T) {
+	SetConfig(Config{MaxPipeline: 1})
+	defer SetConfig(defaultConfig)
+	rc := &runnerConn{loopConn: &loopConn{closed: make(chan struct{})}, tasks: make(chan func(), 4)}
+	defer close(rc.tasks)
+	var onLoop int32 = -1
+	Register("get", "/loop/async", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Async: true})
+	}, func(c ReqCxtI) {
+		time.Sleep(10 * time.Millisecond)
+		c.JSON(200, "async")
+	})
+	Register("get", "/loop/queued", func(c ReqCxtI) {
+		atomic.StoreInt32(&onLoop, atomic.LoadInt32(&rc.inLoop))
+		c.JSON(200, "queued")
+	})
+	ec := NewEPollConn(rc)
+	ec.Serve([]byte("GET /loop/async HTTP/1.1\r\nHost: rx\r\n\r\n" +
+		"GET /loop/queued HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	go rc.run()
+	select {
+	case <-rc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	// the request read ahead waits for the slot, then runs on the loop.
+	if atomic.LoadInt32(&onLoop) != 1 {
+		t.Fatalf("queued request served off the loop: %d", onLoop)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	Register("get", "/proxy/ip", func(c ReqCxtI) {
+		c.JSON(200, c.ClientIP())
+	})
+	SetConfig(Config{ProxyProtocol: true})
+	defer SetConfig(Config{})
+	addr := serve(t)
+	get := "GET /proxy/ip HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 198, 51, 100, 9, 10, 0, 0, 1, 0x1f, 0x90, 0, 80)
+	// the TLVs take the v2 header over the size of the read buffer.
+	large := append([]byte(nil), v2...)
+	large[15] += 8192 % 256
+	large[14] += 8192 / 256
+	large = append(large, make([]byte, 8192)...)
+	for _, tc := range []struct {
+		pieces []string
+		want   string
+	}{
+		{[]string{"PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n" + get}, `"203.0.113.7"`},
+		{[]string{"PROXY TCP6 2001:db8::1 ", "2001:db8::2 5555 80\r\n", get}, `"2001:db8::1"`},
+		{[]string{"PROXY UNKNOWN\r\n" + get}, `"127.0.0.1"`},
+		{[]string{string(v2[:10]), string(v2[10:]) + get}, `"198.51.100.9"`},
+		{[]string{string(large) + get}, `"198.51.100.9"`},
+	} {
+		rsp := roundTrip(t, addr, tc.pieces...)
+		if got := readBody(t, rsp); got != tc.want {
+			t.Fatalf("%q: %s, want %s", tc.pieces[0], got, tc.want)
+		}
+	}
+
+	// the connection without the header is refused.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte(get))
+	if _, err := http.ReadResponse(bufio.NewReader(c), nil); err == nil {
+		t.Fatal("request without proxy header served")
+	}
+
+	lc := &loopConn{closed: make(chan struct{})}
+	ec := NewEPollConn(lc)
+	ec.Serve([]byte("PROXY TCP4 203.0.113.8 10.0.0.1 "))
+	ec.Serve([]byte("5555 80\r\n" + get))
+	<-lc.closed
+	rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, rsp); got != `"203.0.113.8"` {
+		t.Fatalf("epoll: %s", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	Register("get", "/client/ip", func(c ReqCxtI) {
+		c.JSON(200, c.ClientIP())
+	})
+	addr := serve(t)
+	req := func(header string) string {
+		rsp := roundTrip(t, addr, "GET /client/ip HTTP/1.1\r\nHost: rx\r\n"+header+"\r\n")
+		return readBody(t, rsp)
+	}
+	if got := req("X-Forwarded-For: 203.0.113.7\r\n"); got != `"127.0.0.1"` {
+		t.Fatalf("untrusted peer: %s", got)
+	}
+	if err := SetTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetTrustedProxies(nil) }()
+	for header, want := range map[string]string{
+		"X-Forwarded-For: 198.51.100.1, 203.0.113.7, 10.0.0.2\r\n":                `"203.0.113.7"`,
+		"X-Real-IP: 203.0.113.9\r\n":                                              `"203.0.113.9"`,
+		"X-Forwarded-For: 10.0.0.4, 10.0.0.2\r\n":                                 `"10.0.0.4"`,
+		"Forwarded: for=192.0.2.60;proto=http, for=\"[2001:db8::1]:4711\"\r\n":    `"2001:db8::1"`,
+		"Forwarded: for=192.0.2.60, for=10.0.0.3\r\nX-Forwarded-For: 1.1.1.1\r\n": `"192.0.2.60"`,
+	} {
+		if got := req(header); got != want {
+			t.Fatalf("%q: %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	Register("put", "/expect/upload", echo)
+	RegisterExpect("put", "/expect/upload",
+		&HeaderRule{Required: map[string]string{"Authorization": "token"}},
+		&SizeLimit{MaxBody: 8})
+	addr := serve(t)
+	head := "PUT /expect/upload HTTP/1.1\r\nHost: rx\r\nExpect: 100-continue\r\n"
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	_, _ = c.Write([]byte(head + "Authorization: token\r\nContent-Length: 5\r\n\r\n"))
+	// the body is sent only once the 100 Continue is read.
+	rsp, err := http.ReadResponse(br, nil)
+	if err != nil || rsp.StatusCode != 100 {
+		t.Fatalf("interim %v %v", rsp, err)
+	}
+	_, _ = c.Write([]byte("hello"))
+	rsp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, rsp); got != `"hello"` || rsp.Close {
+		t.Fatalf("final %s close %v", got, rsp.Close)
+	}
+
+	// the rejected requests are answered without the body, and close.
+	for _, tc := range []struct {
+		header string
+		status int
+	}{
+		{"Content-Length: 5\r\n", 400},
+		{"Authorization: token\r\nContent-Length: 9\r\n", 413},
+		{"Authorization: other\r\nTransfer-Encoding: chunked\r\n", 403},
+	} {
+		rsp := roundTrip(t, addr, head+tc.header+"\r\n")
+		readBody(t, rsp)
+		if rsp.StatusCode != tc.status || !rsp.Close {
+			t.Fatalf("%q: %d close %v", tc.header, rsp.StatusCode, rsp.Close)
+		}
+	}
+	rsp = roundTrip(t, addr, "PUT /expect/upload HTTP/1.1\r\nHost: rx\r\nExpect: foo\r\nContent-Length: 1\r\n\r\n")
+	if readBody(t, rsp); rsp.StatusCode != 417 {
+		t.Fatalf("unknown expectation %d", rsp.StatusCode)
+	}
+
+	// the handler rejecting without reading the body closes the
+	// connection, the client is still waiting for the 100 Continue.
+	Register("post", "/expect/deny", func(c ReqCxtI) {
+		c.Abort(401, "denied")
+	})
+	rsp = roundTrip(t, addr, "POST /expect/deny HTTP/1.1\r\nHost: rx\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	if readBody(t, rsp); rsp.StatusCode != 401 || !rsp.Close {
+		t.Fatalf("deny %d close %v", rsp.StatusCode, rsp.Close)
+	}
+}
+
+func TestEPollExpectContinue(t *testing.T) {
+	Register("put", "/expect/epoll", echo)
+	RegisterExpect("put", "/expect/epoll", &HeaderRule{Required: map[string]string{"Authorization": ""}})
+	lc := &loopConn{closed: make(chan struct{})}
+	ec := NewEPollConn(lc)
+	ec.Serve([]byte("POST /framing/echo HTTP/1.1\r\nHost: rx\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	lc.mu.Lock()
+	got := lc.out.String()
+	lc.mu.Unlock()
+	if got != string(continueResponse) {
+		t.Fatalf("interim %q", got)
+	}
+	ec.Serve([]byte("hello"))
+	ec.Serve([]byte("PUT /expect/epoll HTTP/1.1\r\nHost: rx\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	br := bufio.NewReader(&lc.out)
+	for i, status := range []int{100, 200, 400} {
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if readBody(t, rsp); rsp.StatusCode != status {
+			t.Fatalf("response %d status %d, want %d", i, rsp.StatusCode, status)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huaxr/rx/logger"
+)
+
+// DeadlineParser turn the deadline header value to the absolute deadline.
+type DeadlineParser func(value string, now time.Time) (time.Time, error)
+
+var (
+	deadlineHeader string
+	deadlineParser DeadlineParser
+)
+
+var errDeadlineFormat = errors.New("invalid deadline format")
+
+// SetDeadlineHeader set the header carrying the caller time budget,
+// e.g. SetDeadlineHeader("grpc-timeout", ctx.ParseGRPCTimeout).
+// the timeout strategy of the request is tightened to the smaller of the
+// route timeout and the caller budget, the expired requests are rejected
+// with 504 before any handler executes.
+func SetDeadlineHeader(name string, parser DeadlineParser) {
+	if parser == nil {
+		parser = ParseDurationDeadline
+	}
+	deadlineHeader = http.CanonicalHeaderKey(name)
+	deadlineParser = parser
+}
+
+var grpcUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// ParseGRPCTimeout parse the grpc-timeout value, such as "100m" or "5S".
+func ParseGRPCTimeout(value string, now time.Time) (time.Time, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return time.Time{}, errDeadlineFormat
+	}
+	unit, ok := grpcUnits[value[len(value)-1]]
+	if !ok {
+		return time.Time{}, errDeadlineFormat
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, errDeadlineFormat
+	}
+	return now.Add(mulDuration(n, unit)), nil
+}
+
+// mulDuration return n units, the overflow is capped to the max duration.
+func mulDuration(n int64, unit time.Duration) time.Duration {
+	if n > math.MaxInt64/int64(unit) {
+		return math.MaxInt64
+	}
+	if n < math.MinInt64/int64(unit) {
+		return math.MinInt64
+	}
+	return time.Duration(n) * unit
+}
+
+// FormatGRPCTimeout format the remaining budget as the grpc-timeout
+// value to propagate it downstream.
+func FormatGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	// at most 8 digits are allowed.
+	for _, u := range []struct {
+		unit time.Duration
+		sign string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+	} {
+		if d/u.unit < 1e8 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.sign
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Hour), 10) + "H"
+}
+
+// ParseDurationDeadline parse a relative budget, a go duration such as
+// "1.5s" or an integer of milliseconds.
+func ParseDurationDeadline(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return now.Add(mulDuration(ms, time.Millisecond)), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, errDeadlineFormat
+	}
+	return now.Add(d), nil
+}
+
+// ParseUnixMilliDeadline parse an absolute deadline of unix milliseconds.
+func ParseUnixMilliDeadline(value string, now time.Time) (time.Time, error) {
+	ms, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return time.Time{}, errDeadlineFormat
+	}
+	return time.Unix(ms/1e3, ms%1e3*int64(time.Millisecond)), nil
+}
+
+// initDeadline parse the deadline header and open the timeout strategy,
+// it rejects the request arrived already expired.
+func (rc *RequestContext) initDeadline() {
+	if deadlineHeader == "" || rc.request == nil {
+		return
+	}
+	value := rc.request.Header.Get(deadlineHeader)
+	if value == "" {
+		return
+	}
+	deadline, err := deadlineParser(value, rc.time)
+	if err != nil {
+		logger.Log.Warning("%s %q: %v", deadlineHeader, value, err)
+		return
+	}
+	rc.deadline = deadline
+	if !deadline.After(time.Now()) {
+		rc.setAbort(504, "deadline exceeded")
+		return
+	}
+	if rc.StrategyContext == nil {
+		rc.RegisterStrategy(nil)
+	}
+	rc.tightenTimeout()
+}
+
+// expireAt start the timeout of the request at the time, it's kept on
+// the request, the StrategyContext is shared by the requests.
+func (rc *RequestContext) expireAt(t time.Time) {
+	rc.expires = t
+	rc.expire = time.After(time.Until(t))
+}
+
+// tightenTimeout shrink the timeout of the request to the deadline.
+func (rc *RequestContext) tightenTimeout() {
+	if rc.deadline.IsZero() || (rc.expire != nil && !rc.deadline.Before(rc.expires)) {
+		return
+	}
+	rc.expireAt(rc.deadline)
+}
+
+func (rc *RequestContext) SetTimeOut(t time.Duration) {
+	rc.expireAt(time.Now().Add(t))
+	rc.tightenTimeout()
+}
+
+func (rc *RequestContext) Deadline() (time.Time, bool) {
+	return rc.deadline, !rc.deadline.IsZero()
+}
+
+func (rc *RequestContext) Remaining() (time.Duration, bool) {
+	if rc.deadline.IsZero() {
+		return 0, false
+	}
+	return time.Until(rc.deadline), true
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// deadlineGate holds the handler past the deadline.
+var deadlineGate chan struct{}
+
+// deadlineStrategy is registered by every request of the route.
+var deadlineStrategy = &StrategyContext{Timeout: 2 * time.Second}
+
+func init() {
+	Register("get", "/deadline/slow", func(c ReqCxtI) {
+		<-deadlineGate
+		c.String(200, "late")
+	})
+	Register("get", "/deadline/route", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Timeout: 50 * time.Millisecond})
+	}, func(c ReqCxtI) {
+		<-deadlineGate
+		c.String(200, "late")
+	})
+	Register("get", "/deadline/shared", func(c ReqCxtI) {
+		c.RegisterStrategy(deadlineStrategy)
+	}, func(c ReqCxtI) {
+		time.Sleep(100 * time.Millisecond)
+		c.String(200, "ok")
+	})
+}
+
+func TestDeadlineShortened(t *testing.T) {
+	deadlineGate = make(chan struct{})
+	SetDeadlineHeader("X-Deadline", ParseDurationDeadline)
+	t.Cleanup(func() {
+		deadlineHeader, deadlineParser = "", nil
+		close(deadlineGate)
+	})
+	addr := serve(t)
+	for _, path := range []string{"/deadline/slow", "/deadline/route"} {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		req.Header.Set("X-Deadline", "50ms")
+		start := time.Now()
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// answered at the deadline while the handler still waits.
+		if body := readBody(t, rsp); rsp.StatusCode != 504 || body != "deadline exceeded" {
+			t.Fatalf("%s: %d %q", path, rsp.StatusCode, body)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%s: not shortened, %v", path, elapsed)
+		}
+		if !rsp.Close {
+			t.Fatalf("%s: connection kept alive", path)
+		}
+	}
+}
+
+func TestDeadlineSharedStrategy(t *testing.T) {
+	SetDeadlineHeader("X-Deadline", ParseDurationDeadline)
+	defer func() { deadlineHeader, deadlineParser = "", nil }()
+	addr := serve(t)
+	for i, tc := range []struct {
+		deadline string
+		status   int
+		body     string
+	}{
+		{"50ms", 504, "deadline exceeded"},
+		// the deadline of the request before is not left on the strategy.
+		{"", 200, "ok"},
+		{"50ms", 504, "deadline exceeded"},
+		{"", 200, "ok"},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/deadline/shared", nil)
+		if tc.deadline != "" {
+			req.Header.Set("X-Deadline", tc.deadline)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || body != tc.body {
+			t.Fatalf("request %d: %d %q", i, rsp.StatusCode, body)
+		}
+	}
+	if deadlineStrategy.Timeout != 2*time.Second {
+		t.Fatalf("strategy timeout %v", deadlineStrategy.Timeout)
+	}
+}
+
+func TestDeadlineParsers(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	max := now.Add(math.MaxInt64)
+	for _, tc := range []struct {
+		parser DeadlineParser
+		value  string
+		want   time.Time
+		ok     bool
+	}{
+		{ParseGRPCTimeout, "100m", now.Add(100 * time.Millisecond), true},
+		{ParseGRPCTimeout, "5S", now.Add(5 * time.Second), true},
+		{ParseGRPCTimeout, "2M", now.Add(2 * time.Minute), true},
+		{ParseGRPCTimeout, "1H", now.Add(time.Hour), true},
+		{ParseGRPCTimeout, "7u", now.Add(7 * time.Microsecond), true},
+		{ParseGRPCTimeout, "9n", now.Add(9), true},
+		{ParseGRPCTimeout, "0n", now, true},
+		// the 8 digits of hours overflow the duration.
+		{ParseGRPCTimeout, "99999999H", max, true},
+		{ParseGRPCTimeout, "100", time.Time{}, false},
+		{ParseGRPCTimeout, "100s", time.Time{}, false},
+		{ParseGRPCTimeout, "100x", time.Time{}, false},
+		{ParseGRPCTimeout, "m", time.Time{}, false},
+		{ParseGRPCTimeout, "", time.Time{}, false},
+		{ParseGRPCTimeout, "-1m", time.Time{}, false},
+		{ParseGRPCTimeout, "1.5S", time.Time{}, false},
+		{ParseGRPCTimeout, "123456789m", time.Time{}, false},
+		{ParseDurationDeadline, "250", now.Add(250 * time.Millisecond), true},
+		{ParseDurationDeadline, " 1.5s ", now.Add(1500 * time.Millisecond), true},
+		{ParseDurationDeadline, "9223372036854775807", max, true},
+		{ParseDurationDeadline, "-1s", now.Add(-time.Second), true},
+		{ParseDurationDeadline, "soon", time.Time{}, false},
+		{ParseUnixMilliDeadline, "1600000000250", now.Add(250 * time.Millisecond), true},
+		// the past deadline is parsed, the request is rejected by it.
+		{ParseUnixMilliDeadline, "1500000000000", time.Unix(1500000000, 0), true},
+		{ParseUnixMilliDeadline, "-1", time.Unix(0, -int64(time.Millisecond)), true},
+		{ParseUnixMilliDeadline, "9223372036854775807", time.Unix(9223372036854775, 807*int64(time.Millisecond)), true},
+		{ParseUnixMilliDeadline, "1.6e12", time.Time{}, false},
+		{ParseUnixMilliDeadline, "", time.Time{}, false},
+	} {
+		got, err := tc.parser(tc.value, now)
+		if (err == nil) != tc.ok || !got.Equal(tc.want) {
+			t.Fatalf("%q: %v %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+}
+
+func TestFormatGRPCTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Second, "0n"},
+		{0, "0n"},
+		{99999999, "99999999n"},
+		{100 * time.Millisecond, "100000u"},
+		{time.Hour, "3600000m"},
+		{100000 * time.Second, "100000S"},
+		{math.MaxInt64, "2562047H"},
+	} {
+		if got := FormatGRPCTimeout(tc.d); got != tc.want {
+			t.Fatalf("%v: %q, want %q", tc.d, got, tc.want)
+		}
+	}
+	// the formatted budget is parsed back.
+	now := time.Unix(1600000000, 0)
+	for _, d := range []time.Duration{time.Millisecond, 3 * time.Second, 90 * time.Minute, 1000 * time.Hour} {
+		got, err := ParseGRPCTimeout(FormatGRPCTimeout(d), now)
+		if err != nil || got.Sub(now) != d {
+			t.Fatalf("%v: %v %v", d, got.Sub(now), err)
+		}
+	}
+}
+
+func TestDeadlineExpired(t *testing.T) {
+	SetDeadlineHeader("X-Deadline-Ms", ParseUnixMilliDeadline)
+	defer func() { deadlineHeader, deadlineParser = "", nil }()
+	addr := serve(t)
+	past := time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	req, _ := http.NewRequest("GET", "http://"+addr+"/deadline/shared", nil)
+	req.Header.Set("X-Deadline-Ms", strconv.FormatInt(past, 10))
+	start := time.Now()
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rejected before the handlers execute.
+	if body := readBody(t, rsp); rsp.StatusCode != 504 || time.Since(start) >= 100*time.Millisecond {
+		t.Fatalf("%d %q in %v", rsp.StatusCode, body, time.Since(start))
+	}
+}
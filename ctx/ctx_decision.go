@@ -0,0 +1,243 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/huaxr/rx/logger"
+)
+
+type Action int8
+
+const (
+	// Allow goes on to the next strategy.
+	Allow Action = iota
+	// Deny aborts the request with the decision status and message.
+	Deny
+	// Delay holds the request before the next strategy, the goroutine
+	// deciding isn't blocked.
+	Delay
+	// Reroute replaces the rest handler chain with the decision handlers.
+	Reroute
+)
+
+var actionNames = map[Action]string{
+	Allow:   "allow",
+	Deny:    "deny",
+	Delay:   "delay",
+	Reroute: "reroute",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Decision is the result of a ControlStrategy.
+type Decision struct {
+	Action Action
+
+	// Status, Message and Headers build the response of Deny.
+	// Status defaults 403, Message defaults the Reason.
+	Status  int16
+	Message interface{}
+	Headers map[string]string
+
+	// Delay duration of Delay.
+	Delay time.Duration
+
+	// Handlers the handler chain of Reroute.
+	Handlers []handlerFunc
+
+	// Reason is recorded for logging and metrics.
+	Reason string
+	// Strategy the name of the strategy made the decision, it is filled
+	// with the strategy type when it is empty.
+	Strategy string
+}
+
+// Allowed return the Allow decision.
+func Allowed() Decision {
+	return Decision{Action: Allow}
+}
+
+// Denied return the Deny decision with the status and message.
+func Denied(status int16, message interface{}) Decision {
+	return Decision{Action: Deny, Status: status, Message: message}
+}
+
+// Delayed return the Delay decision.
+func Delayed(d time.Duration) Decision {
+	return Decision{Action: Delay, Delay: d}
+}
+
+// Rerouted return the Reroute decision to the handler chain.
+func Rerouted(handlerFuncs ...handlerFunc) Decision {
+	return Decision{Action: Reroute, Handlers: handlerFuncs}
+}
+
+// StrategyFunc adapts the func to a ControlStrategy.
+type StrategyFunc func(c ReqCxtI) Decision
+
+func (f StrategyFunc) Decide(c ReqCxtI) Decision {
+	return f(c)
+}
+
+// StrategyChain decides in order, Deny and Reroute stop the chain. the
+// registered chain holds the request on each Delay, the chain decided
+// by itself returns the Delay of the sum instead.
+type StrategyChain []ControlStrategy
+
+func (sc StrategyChain) Decide(c ReqCxtI) Decision {
+	var delay time.Duration
+	for _, s := range sc {
+		d := s.Decide(c)
+		switch d.Action {
+		case Delay:
+			delay += d.Delay
+		case Deny, Reroute:
+			return d
+		}
+	}
+	if delay > 0 {
+		return Delayed(delay)
+	}
+	return Allowed()
+}
+
+// flatten the nested chains, so that each decision is recorded.
+func (sc StrategyChain) flatten() StrategyChain {
+	flat := make(StrategyChain, 0, len(sc))
+	for _, s := range sc {
+		if sub, ok := s.(StrategyChain); ok {
+			flat = append(flat, sub.flatten()...)
+		} else {
+			flat = append(flat, s)
+		}
+	}
+	return flat
+}
+
+// securityStrategy adapts the SecurityStrategy to the decision chain.
+type securityStrategy struct {
+	SecurityStrategy
+}
+
+func (s securityStrategy) Decide(c ReqCxtI) Decision {
+	err := s.Check(c)
+	if err == nil {
+		return Allowed()
+	}
+	d := Denied(403, err.Error())
+	if se, ok := err.(*SecurityError); ok {
+		d.Status = se.Status
+	}
+	d.Reason = err.Error()
+	d.Strategy = fmt.Sprintf("%T", s.SecurityStrategy)
+	return d
+}
+
+var (
+	observerLock sync.RWMutex
+	observers    []func(c ReqCxtI, d Decision)
+)
+
+// OnDecision register the observer of every decision made by the
+// strategies, for logging and metrics.
+func OnDecision(observer func(c ReqCxtI, d Decision)) {
+	observerLock.Lock()
+	observers = append(observers, observer)
+	observerLock.Unlock()
+}
+
+// decide evaluate the strategies of the registered StrategyContext in
+// order: Limiter, Fusing, Security, then Strategies.
+func (rc *RequestContext) decide() {
+	if rc.Limiter != nil && rc.limiter == nil {
+		if !rc.Limiter.acquire(rc) {
+			d := Denied(503, "service overloaded")
+			d.Strategy = "limiter"
+			rc.apply(d)
+			return
+		}
+		rc.limiter = rc.Limiter
+	}
+
+	chain := make(StrategyChain, 0, len(rc.Strategies)+2)
+	if rc.Fusing != nil {
+		chain = append(chain, rc.Fusing)
+	}
+	if rc.Security != nil {
+		chain = append(chain, securityStrategy{rc.Security})
+	}
+	chain = append(chain, rc.Strategies...)
+	rc.decideChain(chain.flatten())
+}
+
+// decideChain apply the decisions of the flattened chain in order, the
+// rest of the chain is suspended by the Delay.
+func (rc *RequestContext) decideChain(chain StrategyChain) {
+	for i, s := range chain {
+		d := s.Decide(rc)
+		if d.Strategy == "" {
+			d.Strategy = fmt.Sprintf("%T", s)
+		}
+		if !rc.apply(d) {
+			return
+		}
+		if d.Action == Delay && d.Delay > 0 {
+			rest := chain[i+1:]
+			rc.suspend(d.Delay, func() { rc.decideChain(rest) })
+			return
+		}
+	}
+}
+
+// apply record the decision and carry it out, return false when the
+// decision stops the chain. the Delay is carried out by the chain.
+func (rc *RequestContext) apply(d Decision) bool {
+	rc.decisions = append(rc.decisions, d)
+	observerLock.RLock()
+	for _, o := range observers {
+		o(rc, d)
+	}
+	observerLock.RUnlock()
+
+	switch d.Action {
+	case Reroute:
+		s := newStack()
+		for l := len(d.Handlers) - 1; l >= 0; l-- {
+			s.Push(d.Handlers[l])
+		}
+		rc.stack = s
+		return false
+	case Deny:
+		logger.Log.Warning("%s deny %s %s: %d %s", d.Strategy, rc.GetMethod(), rc.GetPath(), d.Status, d.Reason)
+		status, message := d.Status, d.Message
+		if status == 0 {
+			status = 403
+		}
+		if message == nil {
+			message = d.Reason
+		}
+		if message == "" {
+			message = http.StatusText(int(status))
+		}
+		rc.setAbort(status, message)
+		for k, v := range d.Headers {
+			rc.rspHeaders.Set(k, v)
+		}
+		return false
+	}
+	return true
+}
+
+// Decisions return the decisions made on this request.
+func (rc *RequestContext) Decisions() []Decision {
+	return rc.decisions
+}
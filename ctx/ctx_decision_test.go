@@ -0,0 +1,95 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const decisionDelay = 100 * time.Millisecond
+
+func init() {
+	delayed := StrategyFunc(func(c ReqCxtI) Decision { return Delayed(decisionDelay) })
+	Register("get", "/decision/chain", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Strategies: StrategyChain{
+			StrategyChain{delayed, StrategyFunc(func(c ReqCxtI) Decision {
+				switch c.GetQuery("to", "") {
+				case "deny":
+					d := Denied(429, "slow down")
+					d.Headers = map[string]string{"Retry-After": "1"}
+					return d
+				case "reroute":
+					return Rerouted(func(c ReqCxtI) { c.String(200, "rerouted") })
+				}
+				return Allowed()
+			})},
+		}})
+	}, func(c ReqCxtI) {
+		c.String(200, "%d decisions", len(c.(*RequestContext).Decisions()))
+	})
+}
+
+func TestDecisionChain(t *testing.T) {
+	addr := serve(t)
+	for _, tc := range []struct {
+		to     string
+		status int
+		body   string
+	}{
+		{"", 200, "2 decisions"},
+		{"deny", 429, "slow down"},
+		{"reroute", 200, "rerouted"},
+	} {
+		start := time.Now()
+		rsp, err := http.Get("http://" + addr + "/decision/chain?to=" + tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, rsp)
+		if rsp.StatusCode != tc.status || body != tc.body {
+			t.Fatalf("%q: %d %q", tc.to, rsp.StatusCode, body)
+		}
+		if elapsed := time.Since(start); elapsed < decisionDelay {
+			t.Fatalf("%q: not delayed, %v", tc.to, elapsed)
+		}
+		if tc.to == "deny" && rsp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("deny headers %v", rsp.Header)
+		}
+	}
+
+	// the chain decided by itself sums the delays.
+	chain := StrategyChain{
+		StrategyFunc(func(c ReqCxtI) Decision { return Delayed(time.Second) }),
+		StrategyFunc(func(c ReqCxtI) Decision { return Delayed(time.Second) }),
+	}
+	if d := chain.Decide(nil); d.Action != Delay || d.Delay != 2*time.Second {
+		t.Fatalf("chain decision %+v", d)
+	}
+}
+
+func TestEPollDecisionDelay(t *testing.T) {
+	lc := &loopConn{closed: make(chan struct{})}
+	start := time.Now()
+	NewEPollConn(lc).Serve([]byte("GET /decision/chain HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	// the loop goes on serving the other connections meanwhile.
+	if elapsed := time.Since(start); elapsed >= decisionDelay {
+		t.Fatalf("the loop blocked %v", elapsed)
+	}
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, rsp); body != "2 decisions" || time.Since(start) < decisionDelay {
+		t.Fatalf("delayed response %q", body)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DecompressConfig of the request bodies with the Content-Encoding.
+type DecompressConfig struct {
+	// Disable keeps the encoded body, the Content-Encoding is left to
+	// the handler.
+	Disable bool
+	// MaxSize limits the decompressed body against the zip bombs,
+	// default 32MB, -1 no limit.
+	MaxSize int64
+}
+
+// acceptEncoding the codings decompressed, advertised by the 415.
+const acceptEncoding = "gzip, deflate"
+
+// RegisterDecompress override the decompression of the route, the route
+// must have been registered.
+func RegisterDecompress(method, path string, c DecompressConfig) {
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultConfig.Decompress.MaxSize
+	}
+	mustRouter("RegisterDecompress", method, path).decompress = &c
+}
+
+// decompressConfig return the decompression of the request route.
+func (rc *RequestContext) decompressConfig() DecompressConfig {
+	if r := routerOf(rc.request.Method, rc.request.URL.Path); r != nil && r.decompress != nil {
+		return *r.decompress
+	}
+	return getConfig().Decompress
+}
+
+// contentCodings return the codings of the Content-Encoding in the order
+// applied, identity is skipped. false is returned for the unsupported.
+func contentCodings(h http.Header) ([]string, bool) {
+	var codings []string
+	for _, v := range h["Content-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			switch coding = strings.ToLower(strings.TrimSpace(coding)); coding {
+			case "", "identity":
+			case "gzip", "x-gzip", "deflate":
+				codings = append(codings, coding)
+			default:
+				return nil, false
+			}
+		}
+	}
+	return codings, true
+}
+
+// checkEncoding reject the unsupported Content-Encoding with 415 in the
+// header phase.
+func (rc *RequestContext) checkEncoding() (int16, string) {
+	if _, ok := contentCodings(rc.request.Header); ok || rc.decompressConfig().Disable {
+		return 0, ""
+	}
+	rc.rspHeaders.Set("Accept-Encoding", acceptEncoding)
+	return 415, "unsupported content encoding " + rc.request.Header.Get("Content-Encoding")
+}
+
+// decompress replace the encoded body with the decompressed one, the
+// Content-Encoding and Content-Length are removed as they describe the
+// encoded body.
+func (rc *RequestContext) decompress() {
+	r := rc.request
+	codings, ok := contentCodings(r.Header)
+	if !ok || len(codings) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	cfg := rc.decompressConfig()
+	if cfg.Disable {
+		return
+	}
+	r.Body = &decodedBody{body: r.Body, codings: codings, max: cfg.MaxSize}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+}
+
+// decodedBody decompress the body on the first read, the decompressed
+// bytes are limited by the max.
+type decodedBody struct {
+	body    io.ReadCloser
+	codings []string
+	max     int64
+	r       io.Reader
+	err     error
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = decoder(d.body, d.codings)
+		if d.err == nil && d.max > 0 {
+			d.r = &limitedBody{ReadCloser: ioutil.NopCloser(d.r), remain: d.max}
+		}
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// decoder undo the codings in the reverse order.
+func decoder(r io.Reader, codings []string) (io.Reader, error) {
+	var err error
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate":
+			r, err = inflater(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// inflater return the reader of the deflate body, the zlib format of the
+// RFC and the raw deflate some clients send are both accepted.
+func inflater(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
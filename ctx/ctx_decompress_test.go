@@ -0,0 +1,110 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func init() {
+	Register("post", "/decompress/raw", func(c ReqCxtI) {
+		b, err := ioutil.ReadAll(c.Body())
+		if err != nil {
+			be := readBodyErr(err)
+			c.Abort(be.Status, be.Error())
+			return
+		}
+		c.JSON(200, string(b))
+	})
+	Register("post", "/decompress/off", echo)
+	RegisterDecompress("post", "/decompress/off", DecompressConfig{Disable: true})
+	Register("post", "/decompress/small", echo)
+	RegisterDecompress("post", "/decompress/small", DecompressConfig{MaxSize: 4})
+}
+
+func compress(t *testing.T, coding, s string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw":
+		w, err = flate.NewWriter(&buf, flate.BestSpeed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(s))
+	_ = w.Close()
+	return buf.String()
+}
+
+func encoded(path, coding, contentType, body string) string {
+	return "POST " + path + " HTTP/1.1\r\nHost: x\r\nContent-Encoding: " + coding +
+		"\r\nContent-Type: " + contentType + fmt.Sprintf("\r\nContent-Length: %d\r\n\r\n", len(body)) + body
+}
+
+func TestDecompress(t *testing.T) {
+	addr := serve(t)
+	json := `{"name":"rx","age":3,"tags":["a"]}`
+	for _, tc := range []struct {
+		path, coding, body string
+		status             int
+		want               string
+	}{
+		{"/bind/body", "gzip", compress(t, "gzip", json), 200, `"rx:3:a"`},
+		{"/bind/body", "deflate", compress(t, "deflate", json), 200, `"rx:3:a"`},
+		{"/bind/body", "deflate", compress(t, "raw", json), 200, `"rx:3:a"`},
+		{"/bind/body", "gzip, identity", compress(t, "gzip", json), 200, `"rx:3:a"`},
+		{"/bind/body", "gzip", json, 400, ""},
+		{"/bind/body", "br", json, 415, ""},
+		{"/decompress/raw", "x-gzip", compress(t, "gzip", "hello"), 200, `"hello"`},
+		{"/decompress/raw", "deflate, gzip", compress(t, "gzip", compress(t, "deflate", "hello")), 200, `"hello"`},
+		{"/decompress/off", "br", "hello", 200, `"hello"`},
+		{"/decompress/small", "gzip", compress(t, "gzip", "hello"), 413, ""},
+	} {
+		rsp := roundTrip(t, addr, encoded(tc.path, tc.coding, MIMEJSON, tc.body))
+		body := readBody(t, rsp)
+		if rsp.StatusCode != tc.status || tc.want != "" && body != tc.want {
+			t.Fatalf("%s %s: status %d %s", tc.path, tc.coding, rsp.StatusCode, body)
+		}
+		if tc.status == 415 && rsp.Header.Get("Accept-Encoding") != acceptEncoding {
+			t.Fatalf("415 Accept-Encoding %q", rsp.Header.Get("Accept-Encoding"))
+		}
+	}
+
+	// the zip bomb stops at the MaxSize.
+	SetConfig(Config{Decompress: DecompressConfig{MaxSize: 1 << 10}})
+	defer SetConfig(Config{})
+	bomb := compress(t, "gzip", strings.Repeat("0", 1<<20))
+	rsp := roundTrip(t, addr, encoded("/decompress/raw", "gzip", "text/plain", bomb))
+	if readBody(t, rsp); rsp.StatusCode != 413 {
+		t.Fatalf("bomb status %d", rsp.StatusCode)
+	}
+
+	contentType, form := multipartBody(t, part{"name", "", "rx"}, part{"file", "a.txt", "hello"})
+	req, _ := http.NewRequest("POST", "http://"+addr+"/multipart/form", strings.NewReader(compress(t, "gzip", form.String())))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+	mrsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, mrsp); body != `"rx a.txt:5:text/plain; charset=utf-8:true"` {
+		t.Fatalf("multipart %d %s", mrsp.StatusCode, body)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// RegisterExpect register the header phase checks of the route, they
+// run once the headers are read and before any byte of the body is
+// read, e.g. the auth, the SizeLimit or the content type. a rejected
+// request is responded without reading the body, the client waiting
+// with "Expect: 100-continue" never sends it. the route must have been
+// registered.
+func RegisterExpect(method, path string, checks ...SecurityStrategy) {
+	r := mustRouter("RegisterExpect", method, path)
+	r.expect = append(r.expect, checks...)
+}
+
+// expectsContinue report whether the client waits for 100 Continue,
+// the expectation of HTTP/1.0 is ignored.
+func expectsContinue(r *http.Request) bool {
+	return r.ProtoAtLeast(1, 1) && strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// headerPhase run the header phase of the request: the unknown
+// expectation is rejected with 417, the unsupported Content-Encoding
+// with 415, then the route checks run. return
+// the status rejected, 0 to go on reading the body.
+func (rc *RequestContext) headerPhase() (int16, string) {
+	r := rc.request
+	if expect := r.Header.Get("Expect"); expect != "" && r.ProtoAtLeast(1, 1) && !strings.EqualFold(expect, "100-continue") {
+		return 417, "unsupported expectation " + expect
+	}
+	if status, message := rc.checkEncoding(); status != 0 {
+		return status, message
+	}
+	router := routerOf(r.Method, r.URL.Path)
+	if router == nil || len(router.expect) == 0 {
+		return 0, ""
+	}
+	err := router.expect.Check(rc)
+	if err == nil {
+		return 0, ""
+	}
+	if se, ok := err.(*SecurityError); ok {
+		return se.Status, se.Reason
+	}
+	return 403, err.Error()
+}
+
+// rejectEarly abort the request rejected in the header phase, the body
+// left on the connection closes it.
+func (rc *RequestContext) rejectEarly() bool {
+	status, message := rc.headerPhase()
+	if status == 0 {
+		return false
+	}
+	rc.setAbort(status, message)
+	if rc.request.ContentLength != 0 {
+		rc.keepAlive = false
+	}
+	return true
+}
+
+// continueBody sends the 100 Continue on the first read of the body,
+// after the responses of the previous pipelined requests.
+type continueBody struct {
+	io.ReadCloser
+	once sync.Once
+	w    io.Writer
+	prev <-chan struct{}
+	sent bool
+}
+
+func (cb *continueBody) Read(p []byte) (int, error) {
+	cb.once.Do(func() {
+		if cb.prev != nil {
+			<-cb.prev
+		}
+		_, _ = cb.w.Write(continueResponse)
+		cb.sent = true
+	})
+	return cb.ReadCloser.Read(p)
+}
+
+// expectContinue defer the 100 Continue to the first read of the body.
+func (rc *RequestContext) expectContinue() {
+	if rc.request == nil || !expectsContinue(rc.request) || rc.request.ContentLength == 0 {
+		return
+	}
+	rc.continued = &continueBody{ReadCloser: rc.request.Body, w: rc.conn, prev: rc.prev}
+	rc.request.Body = rc.continued
+}
+
+// continuePending report whether the client still waits for the 100
+// Continue, the connection is closed since the body may never come.
+func (rc *RequestContext) continuePending() bool {
+	return rc.continued != nil && !rc.continued.sent
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter is an AIMD concurrency limiter. It observes the latency
+// of each route and the dispatch queue depth of the server, additively
+// raises the admitted concurrency while the routes stay fast and
+// multiplicatively lowers it once latency rises above the route baseline.
+// requests over the limit are rejected with 503.
+// share one limiter between the StrategyContext of the routes it protects:
+// c.RegisterStrategy(&ctx.StrategyContext{Limiter: limiter})
+type AdaptiveLimiter struct {
+	name string
+
+	// MinLimit and MaxLimit bound the admitted concurrency.
+	MinLimit int32
+	MaxLimit int32
+	// InitialLimit the concurrency admitted before the latency is
+	// observed, default MaxLimit, so the first burst isn't shed.
+	InitialLimit int32
+	// Tolerance is the ratio of the smoothed latency to the route baseline
+	// latency accepted before the limit decreases.
+	Tolerance float64
+	// Backoff is the multiplicative decrease factor.
+	Backoff float64
+	// MaxQueue is the dispatch queue depth above which the limit decreases
+	// and new requests are shed. 0 disables the queue check.
+	MaxQueue int
+
+	// PriorityHeader marks the requests carrying a non empty value of this
+	// header as prioritized.
+	PriorityHeader string
+	// PriorityRoutes marks the routes as prioritized, e.g. "get::/ping".
+	PriorityRoutes []string
+	// Reserve is the fraction of the limit only prioritized requests use.
+	Reserve float64
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int32
+	routes   map[string]*routeLatency
+	priority map[string]bool
+	admitted uint64
+	rejected uint64
+}
+
+type routeLatency struct {
+	ewma     time.Duration
+	baseline time.Duration
+	lastDrop time.Time
+}
+
+// LimiterStats is the snapshot of an AdaptiveLimiter.
+type LimiterStats struct {
+	Name       string
+	Limit      int32
+	Inflight   int32
+	QueueDepth int
+	Admitted   uint64
+	Rejected   uint64
+	// Latency the smoothed latency of each observed route.
+	Latency map[string]time.Duration
+}
+
+var (
+	limiterLock sync.Mutex
+	// limiters the reported limiters by name, the limiter built later
+	// replaces the one of the same name.
+	limiters = map[string]*AdaptiveLimiter{}
+
+	// queueDepth reports the dispatch queue depth of the running server.
+	queueDepth = func() int { return 0 }
+)
+
+// NewAdaptiveLimiter return a limiter with the default options, it's
+// stats are reported by the server heartbeat under the name. build it
+// once and share it, the reported one is replaced by the limiter built
+// later with the same name.
+func NewAdaptiveLimiter(name string) *AdaptiveLimiter {
+	l := &AdaptiveLimiter{
+		name:      name,
+		MinLimit:  4,
+		MaxLimit:  1 << 10,
+		Tolerance: 2,
+		Backoff:   0.9,
+	}
+	limiterLock.Lock()
+	limiters[name] = l
+	limiterLock.Unlock()
+	return l
+}
+
+// SetQueueDepth register the dispatch queue depth source, the engine
+// registers it when the server starts. it's read on each request, keep
+// it cheap, e.g. an atomic counter.
+func SetQueueDepth(depth func() int) {
+	if depth != nil {
+		queueDepth = depth
+	}
+}
+
+// GetLimiterStats return the stats of all the limiters sorted by name.
+func GetLimiterStats() []LimiterStats {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	stats := make([]LimiterStats, 0, len(limiters))
+	for _, l := range limiters {
+		stats = append(stats, l.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (l *AdaptiveLimiter) lazyInit() {
+	if l.routes != nil {
+		return
+	}
+	if l.MinLimit <= 0 {
+		l.MinLimit = 1
+	}
+	if l.MaxLimit < l.MinLimit {
+		l.MaxLimit = l.MinLimit
+	}
+	if l.Tolerance <= 1 {
+		l.Tolerance = 2
+	}
+	if l.Backoff <= 0 || l.Backoff >= 1 {
+		l.Backoff = 0.9
+	}
+	switch {
+	case l.InitialLimit <= 0 || l.InitialLimit > l.MaxLimit:
+		l.limit = float64(l.MaxLimit)
+	case l.InitialLimit < l.MinLimit:
+		l.limit = float64(l.MinLimit)
+	default:
+		l.limit = float64(l.InitialLimit)
+	}
+	l.routes = make(map[string]*routeLatency)
+	l.priority = make(map[string]bool, len(l.PriorityRoutes))
+	for _, r := range l.PriorityRoutes {
+		l.priority[r] = true
+	}
+}
+
+func (l *AdaptiveLimiter) isPriority(rc *RequestContext, key string) bool {
+	if l.priority[key] {
+		return true
+	}
+	return l.PriorityHeader != "" && rc.request != nil && rc.request.Header.Get(l.PriorityHeader) != ""
+}
+
+// acquire admit the request when the inflight requests under the limit.
+func (l *AdaptiveLimiter) acquire(rc *RequestContext) bool {
+	// the depth is read before the lock, the requests don't serialize
+	// on the engine.
+	queued := l.queued()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lazyInit()
+
+	key := rc.getPathKey()
+	limit := l.limit
+	if !l.isPriority(rc, key) {
+		if queued {
+			l.rejected++
+			return false
+		}
+		limit -= limit * l.Reserve
+	}
+	if float64(l.inflight) >= math.Max(limit, 1) {
+		l.rejected++
+		return false
+	}
+	l.inflight++
+	l.admitted++
+	return true
+}
+
+// release observe the latency of the finished request and adjust the limit.
+func (l *AdaptiveLimiter) release(key string, latency time.Duration) {
+	queued := l.queued()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+
+	rl, ok := l.routes[key]
+	if !ok {
+		rl = &routeLatency{ewma: latency, baseline: latency}
+		l.routes[key] = rl
+	}
+	rl.ewma = (rl.ewma*4 + latency) / 5
+	if latency < rl.baseline {
+		rl.baseline = latency
+	} else {
+		// the baseline drifts slowly to follow a route which gets slower
+		// by design, otherwise it would be shed forever.
+		rl.baseline += (rl.ewma - rl.baseline) / 100
+	}
+
+	overload := float64(rl.ewma) > float64(rl.baseline)*l.Tolerance || queued
+	now := time.Now()
+	switch {
+	case overload && now.Sub(rl.lastDrop) > rl.ewma:
+		// decrease once per latency window, the requests of the same
+		// window observe the same congestion.
+		rl.lastDrop = now
+		l.limit = math.Max(float64(l.MinLimit), l.limit*l.Backoff)
+	case !overload:
+		l.limit = math.Min(float64(l.MaxLimit), l.limit+1/l.limit)
+	}
+}
+
+// queued report whether the dispatch queue is deeper than the MaxQueue.
+func (l *AdaptiveLimiter) queued() bool {
+	return l.MaxQueue > 0 && queueDepth() > l.MaxQueue
+}
+
+// Stats return the snapshot of the limiter.
+func (l *AdaptiveLimiter) Stats() LimiterStats {
+	depth := queueDepth()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lazyInit()
+	s := LimiterStats{
+		Name:       l.name,
+		Limit:      int32(l.limit),
+		Inflight:   l.inflight,
+		QueueDepth: depth,
+		Admitted:   l.admitted,
+		Rejected:   l.rejected,
+		Latency:    make(map[string]time.Duration, len(l.routes)),
+	}
+	for k, v := range l.routes {
+		s.Latency[k] = v.ewma
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// limiterGate holds the requests admitted by the limiter of the route.
+var (
+	limiterGate    chan struct{}
+	limiterEntered = make(chan struct{}, 1)
+	routeLimiter   *AdaptiveLimiter
+)
+
+func init() {
+	Register("get", "/limiter/slow", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Limiter: routeLimiter})
+	}, func(c ReqCxtI) {
+		limiterEntered <- struct{}{}
+		<-limiterGate
+		c.String(200, "done")
+	})
+}
+
+func limiterRequest() *RequestContext {
+	rc := &RequestContext{}
+	rc.request, _ = http.NewRequest("GET", "http://rx/limiter", nil)
+	return rc
+}
+
+func TestLimiterAdjust(t *testing.T) {
+	l := &AdaptiveLimiter{MinLimit: 2, MaxLimit: 64, InitialLimit: 8, Tolerance: 2, Backoff: 0.5}
+	rc := limiterRequest()
+	if !l.acquire(rc) || l.Stats().Limit != 8 {
+		t.Fatalf("initial limit %d", l.Stats().Limit)
+	}
+	l.release(rc.getPathKey(), time.Millisecond)
+
+	// the steady latency grows the limit additively.
+	for i := 0; i < 100; i++ {
+		l.acquire(rc)
+		l.release(rc.getPathKey(), time.Millisecond)
+	}
+	grown := l.Stats().Limit
+	if grown <= 8 {
+		t.Fatalf("limit not grown: %d", grown)
+	}
+
+	// the latency over the tolerance shrinks it multiplicatively, once
+	// per latency window, down to the MinLimit.
+	for i := 0; i < 20; i++ {
+		l.acquire(rc)
+		l.release(rc.getPathKey(), 50*time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	if shrunk := l.Stats().Limit; shrunk >= grown {
+		t.Fatalf("limit not shrunk: %d", shrunk)
+	}
+	for i := 0; i < 50; i++ {
+		l.acquire(rc)
+		l.release(rc.getPathKey(), time.Second)
+		l.routes[rc.getPathKey()].lastDrop = time.Time{}
+	}
+	if s := l.Stats(); s.Limit != 2 || s.Inflight != 0 {
+		t.Fatalf("limit %d inflight %d", s.Limit, s.Inflight)
+	}
+
+	// the default initial limit admits the first burst.
+	burst := &AdaptiveLimiter{MinLimit: 1, MaxLimit: 16}
+	for i := 0; i < 16; i++ {
+		if !burst.acquire(rc) {
+			t.Fatalf("request %d of the burst shed", i)
+		}
+	}
+	if burst.acquire(rc) {
+		t.Fatal("request over the MaxLimit admitted")
+	}
+}
+
+func TestLimiterRegistry(t *testing.T) {
+	first := NewAdaptiveLimiter("registry")
+	for i := 0; i < 100; i++ {
+		NewAdaptiveLimiter("registry")
+	}
+	limiterLock.Lock()
+	n, replaced := len(limiters), limiters["registry"] != first
+	limiterLock.Unlock()
+	if n > 10 || !replaced {
+		t.Fatalf("limiters %d replaced %v", n, replaced)
+	}
+}
+
+func TestLimiterShed(t *testing.T) {
+	limiterGate = make(chan struct{})
+	routeLimiter = &AdaptiveLimiter{name: "test", MinLimit: 1, MaxLimit: 1}
+	addr := serve(t)
+	first := make(chan *http.Response, 1)
+	go func() {
+		rsp, err := http.Get("http://" + addr + "/limiter/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		first <- rsp
+	}()
+	<-limiterEntered
+	rsp, err := http.Get("http://" + addr + "/limiter/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, rsp); rsp.StatusCode != 503 {
+		t.Fatalf("over the limit: %d %s", rsp.StatusCode, body)
+	}
+	close(limiterGate)
+	if rsp := <-first; rsp == nil || rsp.StatusCode != 200 {
+		t.Fatal("admitted request failed")
+	}
+	if s := routeLimiter.Stats(); s.Rejected != 1 || s.Admitted != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	depth := 0
+	l := &AdaptiveLimiter{MinLimit: 4, MaxLimit: 4, MaxQueue: 8, Reserve: 0.5, PriorityHeader: "X-Priority"}
+	// the depth is read outside the lock of the limiter.
+	queueDepth = func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return depth
+	}
+	defer func() { queueDepth = func() int { return 0 } }()
+	rc, vip := limiterRequest(), limiterRequest()
+	vip.request.Header.Set("X-Priority", "1")
+
+	// the reserved half of the limit is left to the prioritized requests.
+	if !l.acquire(rc) || !l.acquire(rc) || l.acquire(rc) {
+		t.Fatal("the reserve admitted")
+	}
+	if !l.acquire(vip) {
+		t.Fatal("prioritized request shed")
+	}
+	l.release(rc.getPathKey(), time.Millisecond)
+
+	// the deep queue sheds the request under the limit.
+	depth = 9
+	if l.acquire(rc) {
+		t.Fatal("request admitted over the MaxQueue")
+	}
+	if !l.acquire(vip) {
+		t.Fatal("prioritized request shed by the queue")
+	}
+	if s := l.Stats(); s.Admitted != 4 || s.Rejected != 2 || s.QueueDepth != 9 {
+		t.Fatalf("stats %+v", s)
+	}
+}
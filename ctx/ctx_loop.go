@@ -0,0 +1,391 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+
+	"github.com/huaxr/rx/internal"
+	"github.com/huaxr/rx/logger"
+)
+
+// LoopConn is the connection of the epoll engine. the responses may be
+// completed off the loop, so Write and Close queue the work for the
+// loop and must be safe for concurrent use.
+type LoopConn interface {
+	// Write queue the response bytes to send.
+	Write(b []byte) (int, error)
+	// Close the connection after the queued responses are sent.
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// LoopRunner is the LoopConn running the work on its loop, the requests
+// read ahead are served on the loop once the previous ones complete off
+// it. the completions of the other LoopConn serve them where they happen.
+type LoopRunner interface {
+	// Loop queue f to run on the loop.
+	Loop(f func())
+}
+
+// EPollConn keeps the request state of a LoopConn. the input is buffered
+// until a request is complete, the pipelined requests of one read are
+// executed in order and their responses are queued in request order.
+type EPollConn struct {
+	conn LoopConn
+
+	mu          sync.Mutex
+	in          []byte
+	last        <-chan struct{}
+	outstanding int
+	closing     bool
+
+	// proxied the PROXY protocol header has been read, remote is the
+	// source address of it.
+	proxied bool
+	remote  net.Addr
+	// expected the header phase of the incomplete request has run.
+	expected bool
+	// framing the parse progress of the incomplete request.
+	framing framing
+}
+
+func NewEPollConn(c LoopConn) *EPollConn {
+	return &EPollConn{conn: c}
+}
+
+// Serve append the data read from the connection and execute the
+// complete requests.
+func (ec *EPollConn) Serve(data []byte) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.closing {
+		return
+	}
+	ec.in = append(ec.in, data...)
+	if getConfig().ProxyProtocol && !ec.proxied {
+		src, n, err := internal.ParseProxyHeader(ec.in)
+		if err == internal.ErrProxyIncomplete {
+			return
+		}
+		if err != nil {
+			logger.Log.Warning("proxy protocol from %s: %v", ec.conn.RemoteAddr(), err)
+			ec.closing = true
+			ec.in = nil
+			_ = ec.conn.Close()
+			return
+		}
+		ec.in = ec.in[n:]
+		ec.proxied = true
+		ec.remote = src
+	}
+	ec.serve()
+}
+
+func (ec *EPollConn) remoteAddr() net.Addr {
+	if ec.remote != nil {
+		return ec.remote
+	}
+	return ec.conn.RemoteAddr()
+}
+
+// serve execute the buffered requests while the outstanding requests
+// are under the MaxPipeline.
+func (ec *EPollConn) serve() {
+	config := getConfig()
+	for !ec.closing && len(ec.in) > 0 && ec.outstanding < config.MaxPipeline {
+		r, n, err := ec.framing.read(ec.in, config)
+		if err == errIncomplete {
+			if r != nil && !ec.expected {
+				ec.expect(r, config)
+			}
+			return
+		}
+		ec.in = ec.in[n:]
+		ec.framing = framing{}
+		checked := ec.expected
+		ec.expected = false
+
+		reqCtx := ec.newContext(r, config)
+		reqCtx.keepAlive = reqCtx.keepAlive && err == nil
+		if err != nil {
+			status, message := readErrStatus(err)
+			if status == 0 {
+				status, message = 400, err.Error()
+			}
+			reqCtx.setAbort(status, message)
+		} else if checked || !reqCtx.rejectEarly() {
+			reqCtx.decompress()
+		}
+		ec.dispatch(reqCtx)
+	}
+}
+
+// newContext return the context of the request read.
+func (ec *EPollConn) newContext(r *http.Request, config *Config) *RequestContext {
+	reqCtx := reqCtxPool.Get().(*RequestContext)
+	reqCtx.init()
+	reqCtx.setMod(EPoll)
+	reqCtx.setRawSock(ec.conn)
+	reqCtx.setRequest(r)
+	reqCtx.keepAlive = r != nil && !r.Close && !config.DisableKeepAlive
+	if addr := ec.remoteAddr(); r != nil && addr != nil {
+		r.RemoteAddr = addr.String()
+	}
+	return reqCtx
+}
+
+// dispatch execute the request after the previous ones.
+func (ec *EPollConn) dispatch(reqCtx *RequestContext) {
+	reqCtx.prev = ec.last
+	ec.last = reqCtx.done
+	if !reqCtx.keepAlive {
+		ec.closing = true
+		ec.in = nil
+	}
+
+	ec.outstanding++
+	reqCtx.execute()
+	if isClosed(reqCtx.done) {
+		ec.complete(reqCtx)
+		return
+	}
+	go func() {
+		<-reqCtx.done
+		ec.onLoop(func() {
+			ec.mu.Lock()
+			defer ec.mu.Unlock()
+			ec.complete(reqCtx)
+			// the read ahead requests wait for the slot.
+			ec.serve()
+		})
+	}()
+}
+
+// onLoop run f on the loop of the connection.
+func (ec *EPollConn) onLoop(f func()) {
+	if r, ok := ec.conn.(LoopRunner); ok {
+		r.Loop(f)
+		return
+	}
+	f()
+}
+
+// expect run the header phase of the request whose body is not buffered
+// yet. the client with the Expect header is answered before the body:
+// the rejection closes the connection, otherwise the 100 Continue is
+// queued after the previous responses.
+func (ec *EPollConn) expect(r *http.Request, config *Config) {
+	if r.Header.Get("Expect") == "" {
+		return
+	}
+	ec.expected = true
+	reqCtx := ec.newContext(r, config)
+	if status, message := reqCtx.headerPhase(); status != 0 {
+		reqCtx.setAbort(status, message)
+		reqCtx.keepAlive = false
+		ec.dispatch(reqCtx)
+		return
+	}
+	putContext(reqCtx)
+	if !expectsContinue(r) {
+		return
+	}
+	last, sent := ec.last, make(chan struct{})
+	ec.last = sent
+	if last == nil || isClosed(last) {
+		_, _ = ec.conn.Write(continueResponse)
+		close(sent)
+		return
+	}
+	go func() {
+		<-last
+		_, _ = ec.conn.Write(continueResponse)
+		close(sent)
+	}()
+}
+
+// complete release the request, the connection closes after the last
+// response once closing, or the response dropped the keep-alive.
+func (ec *EPollConn) complete(rc *RequestContext) {
+	ec.outstanding--
+	// the handlers timed out still own the context.
+	if rc.abandoned() {
+		ec.closing = true
+		ec.in = nil
+	} else {
+		if !rc.keepAlive {
+			ec.closing = true
+			ec.in = nil
+		}
+		putContext(rc)
+	}
+	if ec.closing && ec.outstanding == 0 {
+		_ = ec.conn.Close()
+	}
+}
+
+var errChunkLine = errors.New("malformed chunked encoding")
+
+// maxChunkLine the length of a chunk size or trailer line.
+const maxChunkLine = 4 << 10
+
+// framing keeps the parse progress of the buffered request, so that each
+// byte read is scanned once: the headers are parsed once, then the body
+// is awaited by its Content-Length or the chunks up to the terminator.
+type framing struct {
+	req *http.Request
+	// scanned the bytes searched for the end of the headers, head the
+	// length of the headers once parsed.
+	scanned int
+	head    int
+	// end the length of the whole request once it's known.
+	end int
+	// next the offset of the next line of the chunked body, data the
+	// bytes of the current chunk, size the chunk bytes so far.
+	next    int
+	data    int64
+	size    int64
+	inChunk bool
+	trailer bool
+}
+
+// read parse one complete request from the buffer, return the bytes
+// consumed. errIncomplete is returned until the whole request including
+// the body is buffered, with the request once its headers are.
+func (f *framing) read(in []byte, config *Config) (*http.Request, int, error) {
+	if f.req == nil {
+		head := headerEnd(in, f.scanned)
+		if head < 0 {
+			// the partial header line is malformed for http.ReadRequest.
+			if len(in) > config.MaxHeaderBytes {
+				return nil, len(in), errHeaderTooLarge
+			}
+			f.scanned = len(in)
+			return nil, 0, errIncomplete
+		}
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(in[:head])))
+		if err != nil {
+			return nil, len(in), err
+		}
+		if config.MaxBodyBytes > 0 && r.ContentLength > config.MaxBodyBytes {
+			return r, len(in), errBodyTooLarge
+		}
+		f.req, f.head, f.next = r, head, head
+		if !chunked(r) {
+			f.end = head + int(r.ContentLength)
+			if r.ContentLength < 0 {
+				f.end = head
+			}
+		}
+	}
+	if f.end == 0 {
+		if err := f.scanChunks(in, config); err != nil {
+			return f.req, len(in), err
+		}
+	}
+	if f.end == 0 || len(in) < f.end {
+		// the headers are returned for the header phase.
+		return f.req, 0, errIncomplete
+	}
+
+	r, body := f.req, in[f.head:f.end]
+	if chunked(r) {
+		bs, err := ioutil.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		if err != nil {
+			return r, len(in), err
+		}
+		body = bs
+	}
+	// the buffer is reused for the next reads.
+	r.Body = ioutil.NopCloser(bytes.NewReader(append([]byte(nil), body...)))
+	return r, f.end, nil
+}
+
+// scanChunks scan the chunk lines buffered since the last read, end is
+// set once the terminator and the trailer are.
+func (f *framing) scanChunks(in []byte, config *Config) error {
+	for {
+		if f.inChunk {
+			// the chunk data is followed by the line break.
+			if int64(len(in)-f.next) < f.data {
+				return nil
+			}
+			f.next += int(f.data)
+			f.inChunk = false
+		}
+		n := bytes.IndexByte(in[f.next:], '\n')
+		if n < 0 {
+			if len(in)-f.next > maxChunkLine {
+				return errChunkLine
+			}
+			return nil
+		}
+		line := bytes.TrimRight(in[f.next:f.next+n], "\r")
+		f.next += n + 1
+		switch {
+		case f.trailer:
+			if len(line) == 0 {
+				f.end = f.next
+				return nil
+			}
+		case f.data > 0:
+			// the line break after the data.
+			if len(line) != 0 {
+				return errChunkLine
+			}
+			f.data = 0
+		default:
+			if i := bytes.IndexByte(line, ';'); i >= 0 {
+				line = line[:i]
+			}
+			size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+			if err != nil || size < 0 {
+				return errChunkLine
+			}
+			if size == 0 {
+				f.trailer = true
+				continue
+			}
+			if f.size += size; config.MaxBodyBytes > 0 && f.size > config.MaxBodyBytes {
+				return errBodyTooLarge
+			}
+			f.data, f.inChunk = size, true
+		}
+	}
+}
+
+func chunked(r *http.Request) bool {
+	return len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+}
+
+// headerEnd return the length of the headers ending with the empty line,
+// the search goes on from the bytes scanned, -1 until it's buffered.
+func headerEnd(in []byte, scanned int) int {
+	from := scanned - 3
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < len(in); i++ {
+		if in[i] != '\n' {
+			continue
+		}
+		if i+1 < len(in) && in[i+1] == '\n' {
+			return i + 2
+		}
+		if i+2 < len(in) && in[i+1] == '\r' && in[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return -1
+}
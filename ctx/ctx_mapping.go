@@ -0,0 +1,251 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// valueSource is where the field values are looked up.
+type valueSource interface {
+	get(name string) ([]string, bool)
+}
+
+type formSource map[string][]string
+
+func (s formSource) get(name string) ([]string, bool) {
+	vals, ok := s[name]
+	return vals, ok && len(vals) > 0
+}
+
+type headerSource http.Header
+
+func (s headerSource) get(name string) ([]string, bool) {
+	vals, ok := s[http.CanonicalHeaderKey(name)]
+	return vals, ok && len(vals) > 0
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// sourceTags are the tags of the value sources, the field tagged by one
+// of them is bound by that source only.
+var sourceTags = []string{"uri", "query", "header", "form"}
+
+// mapForm set the struct fields of dst with the values of the keys
+// named by the tag, the field name is taken when no source tag presents.
+//
+// the slices take every value of the key, the pointers are allocated
+// when the key presents, the fields of the embedded structs are promoted.
+// `default:"v"` is taken when the key is absent and the field is zero,
+// split by "," for slices. the fields set are recorded in bound, the
+// default is not taken for them by the later sources.
+// time.Time is parsed with `time_format:"layout"` (RFC3339 by default,
+// "unix" and "unixmilli" for the timestamps), time.Duration with
+// time.ParseDuration.
+func mapForm(dst interface{}, values map[string][]string, tag string) error {
+	return mapSource(dst, formSource(values), tag, nil)
+}
+
+func mapSource(dst interface{}, src valueSource, tag string, bound map[uintptr]bool) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return &BindError{Status: 500, Err: errors.New("bind dst must be a non nil pointer")}
+	}
+	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return &BindError{Status: 500, Err: errors.New("bind dst must point to a struct")}
+	}
+	return mapStruct(v, src, tag, bound)
+}
+
+func mapStruct(v reflect.Value, src valueSource, tag string, bound map[uintptr]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Tag.Get(tag)
+		if name == "-" {
+			continue
+		}
+		if idx := strings.Index(name, ","); idx >= 0 {
+			name = name[:idx]
+		}
+		if sf.Anonymous && name == "" {
+			if err := mapEmbedded(v.Field(i), src, tag, bound); err != nil {
+				return err
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			if hasSourceTag(sf) {
+				continue
+			}
+			name = sf.Name
+		}
+		f := v.Field(i)
+		vals, ok := src.get(name)
+		if !ok {
+			// the value bound by the other source is kept.
+			dft, has := sf.Tag.Lookup("default")
+			if !has || !f.IsZero() || bound[f.UnsafeAddr()] {
+				continue
+			}
+			vals = []string{dft}
+			if indirectType(sf.Type).Kind() == reflect.Slice {
+				vals = strings.Split(dft, ",")
+			}
+		}
+		if err := setField(f, vals, sf); err != nil {
+			return bindErr(400, "field %s: %v", name, err)
+		}
+		if bound != nil {
+			bound[f.UnsafeAddr()] = true
+		}
+	}
+	return nil
+}
+
+func hasSourceTag(sf reflect.StructField) bool {
+	for _, tag := range sourceTags {
+		if _, ok := sf.Tag.Lookup(tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mapEmbedded map the promoted fields, the nil embedded pointer is
+// allocated.
+func mapEmbedded(f reflect.Value, src valueSource, tag string, bound map[uintptr]bool) error {
+	if f.Kind() == reflect.Ptr {
+		if f.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		if f.IsNil() {
+			if !f.CanSet() {
+				return nil
+			}
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+	if f.Kind() != reflect.Struct || f.Type() == timeType {
+		return nil
+	}
+	return mapStruct(f, src, tag, bound)
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func setField(f reflect.Value, vals []string, sf reflect.StructField) error {
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		return setField(f.Elem(), vals, sf)
+	}
+	if f.Kind() == reflect.Slice {
+		s := reflect.MakeSlice(f.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			if err := setValue(s.Index(i), val, sf); err != nil {
+				return err
+			}
+		}
+		f.Set(s)
+		return nil
+	}
+	return setValue(f, vals[0], sf)
+}
+
+func setValue(f reflect.Value, val string, sf reflect.StructField) error {
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+	switch f.Type() {
+	case timeType:
+		t, err := parseTime(val, sf.Tag.Get("time_format"))
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(t))
+		return nil
+	case durationType:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+func parseTime(val, layout string) (time.Time, error) {
+	switch layout {
+	case "":
+		return time.Parse(time.RFC3339, val)
+	case "unix", "unixmilli":
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if layout == "unix" {
+			return time.Unix(n, 0), nil
+		}
+		return time.Unix(0, n*int64(time.Millisecond)), nil
+	}
+	return time.Parse(layout, val)
+}
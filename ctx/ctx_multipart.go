@@ -0,0 +1,417 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/huaxr/rx/ctx/storage"
+)
+
+// MultipartConfig limits the multipart forms, 0 means no limit.
+type MultipartConfig struct {
+	// MaxMemory the file bytes of a form kept in memory, the rest are
+	// spilled to the temp files, default 32MB.
+	MaxMemory int64
+	// MaxFileSize limits each file.
+	MaxFileSize int64
+	// MaxTotalSize limits the whole form.
+	MaxTotalSize int64
+	// MaxFiles limits the count of files.
+	MaxFiles int
+	// TempDir of the spilled files, default os.TempDir().
+	TempDir string
+}
+
+// maxValueBytes limits the non file fields of a form.
+const maxValueBytes = 10 << 20
+
+// sniffLen the bytes http.DetectContentType considers.
+const sniffLen = 512
+
+var (
+	errNotMultipart = &BindError{Status: 415, Err: errors.New("request is not multipart")}
+	errNoFile       = &BindError{Status: 400, Err: http.ErrMissingFile}
+)
+
+// Form is the parsed multipart form.
+type Form struct {
+	Value map[string][]string
+	File  map[string][]*FormFile
+}
+
+// removeAll remove the spilled temp files.
+func (f *Form) removeAll() {
+	for _, files := range f.File {
+		for _, ff := range files {
+			if ff.tmpfile != "" {
+				_ = os.Remove(ff.tmpfile)
+			}
+		}
+	}
+}
+
+// FormFile is an uploaded file of the multipart form.
+type FormFile struct {
+	Field string
+	// Filename is the sanitized base name of the client filename.
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	// ContentType is sniffed from the content, the declared type is
+	// in the Header.
+	ContentType string
+
+	content []byte
+	tmpfile string
+}
+
+// Open return the content of the file.
+func (f *FormFile) Open() (multipart.File, error) {
+	if f.tmpfile != "" {
+		return os.Open(f.tmpfile)
+	}
+	return memFile{bytes.NewReader(f.content)}, nil
+}
+
+// GetFile return the opened content of the file, nil on failure.
+func (f *FormFile) GetFile() multipart.File {
+	file, err := f.Open()
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+func (f *FormFile) GetFileSize() int64 {
+	return f.Size
+}
+
+func (f *FormFile) GetFileName() string {
+	return f.Filename
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// SanitizeFilename return the safe base name of the client filename,
+// the directories, the control characters and the leading dots are
+// removed.
+func SanitizeFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == ':' || r == '"' || r == '*' || r == '?' || r == '<' || r == '>' || r == '|' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > 255 {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		// the cut keeps the multibyte rune whole.
+		cut := 255 - len(ext)
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut] + ext
+	}
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// Part is a part of the streamed multipart form, the reads of the file
+// part are limited by the MaxFileSize.
+type Part struct {
+	*multipart.Part
+	r           io.Reader
+	contentType string
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// IsFile report whether the part is a file.
+func (p *Part) IsFile() bool {
+	return p.Part.FileName() != ""
+}
+
+// FileName return the sanitized filename of the file part.
+func (p *Part) FileName() string {
+	if !p.IsFile() {
+		return ""
+	}
+	return SanitizeFilename(p.Part.FileName())
+}
+
+// ContentType return the content type sniffed from the first bytes.
+func (p *Part) ContentType() string {
+	return p.contentType
+}
+
+// multipartReader return the reader of the multipart body limited by the
+// MaxTotalSize.
+func (rc *RequestContext) multipartReader(cfg MultipartConfig) (*multipart.Reader, error) {
+	mt, params, err := mime.ParseMediaType(rc.request.Header.Get("Content-Type"))
+	if err != nil || mt != MIMEMultipartPOSTForm || params["boundary"] == "" {
+		return nil, errNotMultipart
+	}
+	body := rc.Body()
+	if cfg.MaxTotalSize > 0 {
+		if rc.request.ContentLength > cfg.MaxTotalSize {
+			return nil, bindErr(413, "multipart form size %d exceeds %d", rc.request.ContentLength, cfg.MaxTotalSize)
+		}
+		body = &limitedBody{ReadCloser: body, remain: cfg.MaxTotalSize}
+	}
+	return multipart.NewReader(body, params["boundary"]), nil
+}
+
+// EachPart stream the parts of the multipart form to fn in order without
+// buffering, for the large uploads. the part is discarded once fn
+// returns, a non nil error of fn stops the iteration and is returned.
+func (rc *RequestContext) EachPart(fn func(p *Part) error) error {
+	cfg := getConfig().Multipart
+	mr, err := rc.multipartReader(cfg)
+	if err != nil {
+		return err
+	}
+	files := 0
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return multipartErr(err)
+		}
+		part := &Part{Part: p, r: p}
+		if part.IsFile() {
+			if files++; cfg.MaxFiles > 0 && files > cfg.MaxFiles {
+				return bindErr(413, "more than %d files", cfg.MaxFiles)
+			}
+			var r io.Reader = p
+			if cfg.MaxFileSize > 0 {
+				r = &limitedBody{ReadCloser: ioutil.NopCloser(p), remain: cfg.MaxFileSize}
+			}
+			br := bufio.NewReaderSize(r, sniffLen)
+			head, _ := br.Peek(sniffLen)
+			part.r, part.contentType = br, http.DetectContentType(head)
+		}
+		if err := fn(part); err != nil {
+			return multipartErr(err)
+		}
+		// drain the unread part to reach the next boundary.
+		if _, err := io.Copy(ioutil.Discard, part); err != nil {
+			return multipartErr(err)
+		}
+	}
+}
+
+// MultipartForm parse the multipart form, the file bytes beyond the
+// MaxMemory are spilled to the temp files, which are removed once the
+// request is finished. the form is parsed once and cached.
+func (rc *RequestContext) MultipartForm() (*Form, error) {
+	if rc.form != nil {
+		return rc.form, nil
+	}
+	cfg := getConfig().Multipart
+	form := &Form{Value: make(map[string][]string), File: make(map[string][]*FormFile)}
+	memory, values := cfg.MaxMemory, int64(maxValueBytes)
+	err := rc.EachPart(func(p *Part) error {
+		name := p.FormName()
+		if name == "" {
+			return nil
+		}
+		if !p.IsFile() {
+			var buf bytes.Buffer
+			n, err := io.CopyN(&buf, p, values+1)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if values -= n; values < 0 {
+				return bindErr(413, "multipart values too large")
+			}
+			form.Value[name] = append(form.Value[name], buf.String())
+			return nil
+		}
+
+		ff := &FormFile{Field: name, Filename: p.FileName(), Header: p.Header, ContentType: p.ContentType()}
+		form.File[name] = append(form.File[name], ff)
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, p, memory+1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n <= memory {
+			memory -= n
+			ff.content, ff.Size = buf.Bytes(), n
+			return nil
+		}
+		// spill to the temp file.
+		tmp, err := ioutil.TempFile(cfg.TempDir, "rx-multipart-")
+		if err != nil {
+			return err
+		}
+		ff.tmpfile = tmp.Name()
+		size, err := io.Copy(tmp, io.MultiReader(&buf, p))
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		ff.Size = size
+		memory = 0
+		return err
+	})
+	if err != nil {
+		form.removeAll()
+		return nil, err
+	}
+	rc.form = form
+	// the binders read the values of the parsed form.
+	rc.request.MultipartForm = &multipart.Form{Value: form.Value}
+	return form, nil
+}
+
+// multipartErr keep the status of the limits.
+func multipartErr(err error) error {
+	switch err.(type) {
+	case *BindError:
+		return err
+	case *SecurityError:
+		return readBodyErr(err)
+	}
+	return bindErr(400, "malformed multipart form: %v", err)
+}
+
+// File return the first file of the field.
+func (rc *RequestContext) File(field string) (*FormFile, error) {
+	files, err := rc.Files(field)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// Files return the files of the field.
+func (rc *RequestContext) Files(field string) ([]*FormFile, error) {
+	form, err := rc.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	files := form.File[field]
+	if len(files) == 0 {
+		return nil, errNoFile
+	}
+	return files, nil
+}
+
+// FormValue return the first value of the field of the multipart or the
+// url encoded form.
+func (rc *RequestContext) FormValue(field string) string {
+	if mt, _, _ := mime.ParseMediaType(rc.request.Header.Get("Content-Type")); mt == MIMEMultipartPOSTForm {
+		form, err := rc.MultipartForm()
+		if err != nil || len(form.Value[field]) == 0 {
+			return ""
+		}
+		return form.Value[field][0]
+	}
+	rc.request.Body = rc.Body()
+	return rc.request.PostFormValue(field)
+}
+
+// SaveLocalFile save the first file of the field into the dir with the
+// sanitized filename, return the path saved. the existing file is not
+// overwritten, the error of os.IsExist is returned for it.
+func (rc *RequestContext) SaveLocalFile(field, dir string) (string, error) {
+	ff, err := rc.File(field)
+	if err != nil {
+		return "", err
+	}
+	src, err := ff.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	path := filepath.Join(dir, ff.Filename)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path)
+		return "", err
+	}
+	return path, dst.Close()
+}
+
+// UploadHook inspects the uploaded file before it is committed to the
+// storage, e.g. the virus scanning or the thumbnailing. a non nil error
+// rejects the upload.
+type UploadHook func(f *FormFile, content io.Reader) error
+
+// SaveFile save the first file of the field to the storage with the key,
+// the sanitized filename is taken when the key is empty. the hooks run
+// before the put, the content is verified by its sha256 checksum.
+func (rc *RequestContext) SaveFile(field string, s storage.Storage, key string, hooks ...UploadHook) (*storage.Object, error) {
+	ff, err := rc.File(field)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = ff.Filename
+	}
+	src, err := ff.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := hook(ff, src); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.Put(key, src, storage.Meta{
+		ContentType: ff.ContentType,
+		Size:        ff.Size,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+	})
+}
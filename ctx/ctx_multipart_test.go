@@ -0,0 +1,220 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/huaxr/rx/ctx/storage"
+)
+
+// uploadDir receives the files of the SaveLocalFile test, uploadStore
+// the files of the SaveFile test.
+var (
+	uploadDir   string
+	uploadStore = storage.NewMemory()
+)
+
+func init() {
+	Register("post", "/multipart/form", func(c ReqCxtI) {
+		files, err := c.Files("file")
+		if err != nil {
+			c.Abort(err.(*BindError).Status, err.Error())
+			return
+		}
+		var out []string
+		for _, f := range files {
+			b, _ := ioutil.ReadAll(f.GetFile())
+			out = append(out, fmt.Sprintf("%s:%d:%s:%t", f.Filename, f.Size, f.ContentType, len(b) == int(f.Size)))
+		}
+		c.JSON(200, c.FormValue("name")+" "+strings.Join(out, " "))
+	})
+	Register("post", "/multipart/stream", func(c ReqCxtI) {
+		var out []string
+		err := c.EachPart(func(p *Part) error {
+			n, err := io.Copy(ioutil.Discard, p)
+			out = append(out, fmt.Sprintf("%s:%s:%d", p.FormName(), p.FileName(), n))
+			return err
+		})
+		if err != nil {
+			c.Abort(err.(*BindError).Status, err.Error())
+			return
+		}
+		c.JSON(200, strings.Join(out, " "))
+	})
+	Register("post", "/multipart/store", func(c ReqCxtI) {
+		scan := func(f *FormFile, content io.Reader) error {
+			b, _ := ioutil.ReadAll(content)
+			if bytes.Contains(b, []byte("EICAR")) {
+				return errors.New("virus found in " + f.Filename)
+			}
+			return nil
+		}
+		obj, err := c.SaveFile("file", uploadStore, "uploads/"+c.FormValue("name"), scan)
+		if err != nil {
+			c.Abort(422, err.Error())
+			return
+		}
+		c.JSON(200, fmt.Sprintf("%s:%d:%s", obj.Key, obj.Size, obj.ContentType))
+	})
+	Register("post", "/multipart/save", func(c ReqCxtI) {
+		path, err := c.SaveLocalFile("file", uploadDir)
+		if os.IsExist(err) {
+			c.Abort(409, "file exists")
+			return
+		}
+		if err != nil {
+			c.Abort(500, err.Error())
+			return
+		}
+		c.JSON(200, filepath.Base(path))
+	})
+}
+
+type part struct {
+	field, filename, content string
+}
+
+func multipartBody(t *testing.T, parts ...part) (string, *bytes.Buffer) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var pw io.Writer
+		var err error
+		if p.filename == "" {
+			pw, err = w.CreateFormField(p.field)
+		} else {
+			pw, err = w.CreateFormFile(p.field, p.filename)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = pw.Write([]byte(p.content))
+	}
+	_ = w.Close()
+	return w.FormDataContentType(), &buf
+}
+
+func upload(t *testing.T, addr, path string, parts ...part) (int, string) {
+	contentType, body := multipartBody(t, parts...)
+	rsp, err := http.Post("http://"+addr+path, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode, readBody(t, rsp)
+}
+
+func TestMultipartForm(t *testing.T) {
+	SetConfig(Config{Multipart: MultipartConfig{MaxMemory: 16, MaxFileSize: 1 << 10, MaxFiles: 2}})
+	defer SetConfig(Config{})
+	addr := serve(t)
+	tmp := os.TempDir()
+	before, _ := filepath.Glob(filepath.Join(tmp, "rx-multipart-*"))
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	status, body := upload(t, addr, "/multipart/form",
+		part{"name", "", "rx"},
+		part{"file", "../../etc/passwd", "hello"},
+		part{"file", `C:\tmp\a.png`, png})
+	if want := `"rx passwd:5:text/plain; charset=utf-8:true a.png:108:image/png:true"`; status != 200 || body != want {
+		t.Fatalf("status %d body %s", status, body)
+	}
+	// the spilled file is removed after the request.
+	after, _ := filepath.Glob(filepath.Join(tmp, "rx-multipart-*"))
+	if len(after) > len(before) {
+		t.Fatalf("temp files left %v", after)
+	}
+
+	status, body = upload(t, addr, "/multipart/form", part{"file", "big", strings.Repeat("x", 2<<10)})
+	if status != 413 {
+		t.Fatalf("file size: status %d body %s", status, body)
+	}
+	status, body = upload(t, addr, "/multipart/form",
+		part{"file", "a", "a"}, part{"file", "b", "b"}, part{"file", "c", "c"})
+	if status != 413 {
+		t.Fatalf("file count: status %d body %s", status, body)
+	}
+	status, body = upload(t, addr, "/multipart/form", part{"name", "", "rx"})
+	if status != 400 {
+		t.Fatalf("missing file: status %d body %s", status, body)
+	}
+}
+
+func TestMultipartStream(t *testing.T) {
+	addr := serve(t)
+	status, body := upload(t, addr, "/multipart/stream",
+		part{"name", "", "rx"}, part{"file", "../x.bin", strings.Repeat("x", 1<<20)})
+	if want := `"name::2 file:x.bin:1048576"`; status != 200 || body != want {
+		t.Fatalf("status %d body %s", status, body)
+	}
+
+	uploadDir = t.TempDir()
+	status, body = upload(t, addr, "/multipart/save", part{"file", "../../evil.txt", "evil"})
+	if status != 200 || body != `"evil.txt"` {
+		t.Fatalf("status %d body %s", status, body)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(uploadDir, "evil.txt")); err != nil || string(b) != "evil" {
+		t.Fatalf("saved %q %v", b, err)
+	}
+	// the saved file is not overwritten.
+	status, body = upload(t, addr, "/multipart/save", part{"file", "evil.txt", "again"})
+	if status != 409 {
+		t.Fatalf("overwrite: status %d body %s", status, body)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(uploadDir, "evil.txt")); string(b) != "evil" {
+		t.Fatalf("overwritten %q", b)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("文", 100) + ".txt"
+	for name, want := range map[string]string{
+		"../../etc/passwd": "passwd",
+		`C:\tmp\a.png`:     "a.png",
+		"..hidden":         "hidden",
+		"a\x00b:c.txt":     "abc.txt",
+		"":                 "file",
+		long:               strings.Repeat("文", 83) + ".txt",
+	} {
+		got := SanitizeFilename(name)
+		if got != want || !utf8.ValidString(got) || len(got) > 255 {
+			t.Fatalf("%q: %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	addr := serve(t)
+	status, body := upload(t, addr, "/multipart/store", part{"name", "", "a.txt"}, part{"file", "a.txt", "hello"})
+	if status != 200 || body != `"uploads/a.txt:5:text/plain; charset=utf-8"` {
+		t.Fatalf("status %d body %s", status, body)
+	}
+	r, _, err := uploadStore.Open("uploads/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "hello" {
+		t.Fatalf("stored %q", b)
+	}
+
+	status, body = upload(t, addr, "/multipart/store", part{"name", "", "b.txt"}, part{"file", "b.txt", "EICAR"})
+	if status != 422 {
+		t.Fatalf("status %d body %s", status, body)
+	}
+	if _, err := uploadStore.Stat("uploads/b.txt"); err != storage.ErrNotExist {
+		t.Fatalf("rejected upload committed: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Offer is the response in each format for the Negotiate, the formats
+// left nil or empty are not offered. the server prefers them in the
+// order of the fields when the client accepts several equally.
+type Offer struct {
+	JSON interface{}
+	XML  interface{}
+	// HTML the raw html string, or the HTMLOffer of a template.
+	HTML interface{}
+	Text string
+}
+
+// HTMLOffer is the template of the Offer, rendered as c.HTML(Name, Data).
+type HTMLOffer struct {
+	Name string
+	Data interface{}
+}
+
+// formats return the MIME types offered.
+func (o *Offer) formats() []string {
+	var formats []string
+	if o.JSON != nil {
+		formats = append(formats, MIMEJSON)
+	}
+	if o.XML != nil {
+		formats = append(formats, MIMEXML)
+	}
+	if o.HTML != nil && o.HTML != "" {
+		formats = append(formats, MIMEHTML)
+	}
+	if o.Text != "" {
+		formats = append(formats, MIMEPlain)
+	}
+	return formats
+}
+
+// Negotiate render the offer in the format the Accept header prefers,
+// the request is aborted with 406 when none is acceptable.
+func (rc *RequestContext) Negotiate(status int16, offer Offer) {
+	switch rc.NegotiateFormat(offer.formats()...) {
+	case MIMEJSON:
+		rc.JSON(status, offer.JSON)
+	case MIMEXML:
+		rc.XML(status, offer.XML)
+	case MIMEHTML:
+		switch h := offer.HTML.(type) {
+		case HTMLOffer:
+			rc.HTML(status, h.Name, h.Data)
+		default:
+			rc.HTMLString(status, fmt.Sprint(h))
+		}
+	case MIMEPlain:
+		rc.String(status, offer.Text)
+	default:
+		rc.setAbort(406, "not acceptable, available: "+strings.Join(offer.formats(), ", "))
+	}
+}
+
+// NegotiateFormat return the offered MIME type the Accept header prefers,
+// the first offered without the Accept header, "" when none is
+// acceptable. the choice is kept to render the Abort messages, the
+// response varies by the Accept header.
+func (rc *RequestContext) NegotiateFormat(offered ...string) string {
+	addVary(rc.rspHeaders, "Accept")
+	rc.negotiated = negotiate(rc.request.Header.Get("Accept"), offered)
+	return rc.negotiated
+}
+
+// mediaRange is a media range of the Accept header.
+type mediaRange struct {
+	typ, sub string
+	q        float64
+}
+
+// parseAccept parse the media ranges of the Accept header, the invalid
+// ones are skipped.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		typ := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.IndexByte(typ, '/')
+		if slash <= 0 || slash == len(typ)-1 {
+			continue
+		}
+		mr := mediaRange{typ: typ[:slash], sub: typ[slash+1:], q: 1}
+		if typ == "text/xml" {
+			// the legacy name of the XML offered.
+			mr.typ, mr.sub = "application", "xml"
+		}
+		if mr.typ == "*" && mr.sub != "*" {
+			continue
+		}
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				mr.q = q
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// quality return the q of the most specific range matching the type,
+// -1 when none matches.
+func quality(ranges []mediaRange, mimeType string) float64 {
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	slash := strings.IndexByte(mimeType, '/')
+	if slash < 0 {
+		return -1
+	}
+	typ, sub := mimeType[:slash], mimeType[slash+1:]
+	q, specificity := -1.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.typ == typ && r.sub == sub:
+			s = 2
+		case r.typ == typ && r.sub == "*":
+			s = 1
+		case r.typ == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// negotiate return the offered type of the highest q, the earlier one
+// wins the tie.
+func negotiate(accept string, offered []string) string {
+	if len(offered) == 0 {
+		return ""
+	}
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return offered[0]
+	}
+	best, bestQ := "", 0.0
+	for _, o := range offered {
+		if q := quality(ranges, o); q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+	return best
+}
+
+// abortXML is the XML of the Abort message.
+type abortXML struct {
+	XMLName xml.Name `xml:"error"`
+	Status  int16    `xml:"status"`
+	Message string   `xml:"message"`
+}
+
+// renderAbort render the Abort message in the format negotiated by the
+// handler, or else the Accept header prefers. the string message is
+// offered in HTML, JSON, XML and text, the others in JSON only.
+func (rc *RequestContext) renderAbort() {
+	msg, ok := rc.abortContext.message.(string)
+	if !ok || rc.request == nil {
+		rc.rspBody = rc.abortContext.GetAbortMessage()
+		return
+	}
+	offered := []string{MIMEHTML, MIMEJSON, MIMEXML, MIMEPlain}
+	addVary(rc.rspHeaders, "Accept")
+	format := rc.negotiated
+	if !contains(offered, format) {
+		format = negotiate(rc.request.Header.Get("Accept"), offered)
+	}
+	// the Abort replaces the body rendered.
+	rc.rendered = false
+	status := rc.abortContext.abortStatus
+	switch format {
+	case MIMEJSON:
+		rc.JSON(status, map[string]interface{}{"message": msg})
+	case MIMEXML:
+		rc.XML(status, abortXML{Status: status, Message: msg})
+	case MIMEPlain:
+		rc.String(status, msg)
+	default:
+		if !rc.renderErrorPage(status, msg) {
+			rc.rspBody = rc.abortContext.GetAbortMessage()
+		}
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"net/http"
+	"testing"
+)
+
+func init() {
+	Register("get", "/negotiate/offer", func(c ReqCxtI) {
+		c.Negotiate(200, Offer{JSON: renderItem{Name: "rx"}, XML: renderItem{Name: "rx"}, HTML: "<p>rx</p>"})
+	})
+	Register("get", "/negotiate/abort", func(c ReqCxtI) {
+		if c.GetQuery("format", "") != "" {
+			c.NegotiateFormat(MIMEPlain, MIMEJSON)
+		}
+		c.Abort(403, "denied")
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{MIMEJSON, MIMEXML, MIMEHTML}
+	for accept, want := range map[string]string{
+		"":                                    MIMEJSON,
+		"*/*":                                 MIMEJSON,
+		"garbage":                             MIMEJSON,
+		"application/xml":                     MIMEXML,
+		"text/*, application/json;q=0.5":      MIMEHTML,
+		"application/*;q=0.2, text/html":      MIMEHTML,
+		"application/*, application/json;q=0": MIMEXML,
+		"text/html;q=0.8, application/xml;q=0.9, */*;q=0.1":               MIMEXML,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": MIMEHTML,
+		"image/png":                       "",
+		"*/*;q=0":                         "",
+		"APPLICATION/XML;Q=1":             MIMEXML,
+		"text/xml":                        MIMEXML,
+		"text/xml;q=0.9, text/html;q=0.5": MIMEXML,
+	} {
+		if got := negotiate(accept, offered); got != want {
+			t.Fatalf("%q: %q, want %q", accept, got, want)
+		}
+	}
+
+	addr := serve(t)
+	get := func(path, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp, readBody(t, rsp)
+	}
+	for _, tc := range []struct {
+		path, accept string
+		status       int
+		contentType  string
+		body         string
+	}{
+		{"/negotiate/offer", "", 200, "application/json", `{"name":"rx","tag":""}`},
+		{"/negotiate/offer", "text/xml, application/xml", 200, "application/xml; charset=utf-8", `<renderItem><name>rx</name><tag></tag></renderItem>`},
+		{"/negotiate/offer", "text/xml", 200, "application/xml; charset=utf-8", `<renderItem><name>rx</name><tag></tag></renderItem>`},
+		{"/negotiate/offer", "text/html", 200, "text/html; charset=utf-8", "<p>rx</p>"},
+		{"/negotiate/offer", "image/png", 406, "text/html", "not acceptable, available: application/json, application/xml, text/html"},
+		{"/negotiate/abort", "", 403, "text/html", "denied"},
+		{"/negotiate/abort", "application/json", 403, "application/json", `{"message":"denied"}`},
+		{"/negotiate/abort", "application/xml", 403, "application/xml; charset=utf-8", `<error><status>403</status><message>denied</message></error>`},
+		{"/negotiate/abort?format=1", "", 403, "text/plain; charset=utf-8", "denied"},
+		{"/negotiate/missing", "application/json", 404, "application/json", `{"message":"Page not found"}`},
+	} {
+		rsp, body := get(tc.path, tc.accept)
+		if rsp.StatusCode != tc.status || rsp.Header.Get("Content-Type") != tc.contentType || body != tc.body {
+			t.Fatalf("%s %q: %d %q %s", tc.path, tc.accept, rsp.StatusCode, rsp.Header.Get("Content-Type"), body)
+		}
+		// the caches key the negotiated response by the Accept.
+		if vary := rsp.Header.Values("Vary"); len(vary) != 1 || vary[0] != "Accept" {
+			t.Fatalf("%s %q: Vary %v", tc.path, tc.accept, vary)
+		}
+	}
+}
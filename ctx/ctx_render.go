@@ -0,0 +1,134 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+
+	"github.com/huaxr/rx/internal"
+	"github.com/huaxr/rx/logger"
+)
+
+const (
+	contentJSON       = internal.MIMEJSON
+	contentXML        = internal.MIMEXML + "; charset=utf-8"
+	contentPlain      = internal.MIMEPlain + "; charset=utf-8"
+	contentHTML       = internal.MIMEHTML + "; charset=utf-8"
+	contentJavaScript = internal.MIMEJavaScript + "; charset=utf-8"
+)
+
+// render commit the body of the response, the body of the previous
+// render is replaced.
+func (rsp *responseContext) render(status int16, contentType string, body []byte) {
+	if rsp.rendered {
+		logger.Log.Warning("response rendered twice, the previous body is replaced")
+	}
+	rsp.rendered = true
+	rsp.status = status
+	if contentType == "" {
+		rsp.rspHeaders.Del("Content-Type")
+	} else {
+		rsp.rspHeaders.Set("Content-Type", contentType)
+	}
+	rsp.rspBody = append(rsp.rspBody[:0], body...)
+}
+
+// renderErr respond 500 for the value can't be marshaled.
+func (rsp *responseContext) renderErr(err error) {
+	logger.Log.Error("marshal err: %v", err)
+	rsp.render(500, contentPlain, []byte("marshal response failed"))
+}
+
+func (rsp *responseContext) JSON(status int16, response interface{}) {
+	bits, err := json.Marshal(response)
+	if err != nil {
+		rsp.renderErr(err)
+		return
+	}
+	rsp.render(status, contentJSON, bits)
+}
+
+func (rsp *responseContext) PureJSON(status int16, response interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(response); err != nil {
+		rsp.renderErr(err)
+		return
+	}
+	// the Encoder ends the value with a newline.
+	rsp.render(status, contentJSON, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func (rsp *responseContext) IndentedJSON(status int16, response interface{}) {
+	bits, err := json.MarshalIndent(response, "", "    ")
+	if err != nil {
+		rsp.renderErr(err)
+		return
+	}
+	rsp.render(status, contentJSON, bits)
+}
+
+func (rsp *responseContext) XML(status int16, response interface{}) {
+	bits, err := xml.Marshal(response)
+	if err != nil {
+		rsp.renderErr(err)
+		return
+	}
+	rsp.render(status, contentXML, bits)
+}
+
+func (rsp *responseContext) String(status int16, format string, values ...interface{}) {
+	if len(values) > 0 {
+		format = fmt.Sprintf(format, values...)
+	}
+	rsp.render(status, contentPlain, internal.StringToBytes(format))
+}
+
+func (rsp *responseContext) HTMLString(status int16, html string) {
+	rsp.render(status, contentHTML, internal.StringToBytes(html))
+}
+
+func (rsp *responseContext) Data(status int16, contentType string, data []byte) {
+	rsp.render(status, contentType, data)
+}
+
+func (rsp *responseContext) Redirect(status int16, location string) {
+	if (status < 300 || status > 308) && status != 201 {
+		logger.Log.Error("redirect with status %d", status)
+		rsp.render(500, contentPlain, []byte("invalid redirect status"))
+		return
+	}
+	rsp.render(status, "", nil)
+	rsp.rspHeaders.Set("Location", location)
+}
+
+func (rsp *responseContext) NoContent(status int16) {
+	rsp.render(status, "", nil)
+}
+
+// jsonpCallback the valid javascript identifiers and member accesses,
+// the others would inject the script.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+func (rc *RequestContext) JSONP(status int16, response interface{}) {
+	callback := rc.GetQuery("callback", "")
+	if !jsonpCallback.MatchString(callback) {
+		rc.JSON(status, response)
+		return
+	}
+	bits, err := json.Marshal(response)
+	if err != nil {
+		rc.renderErr(err)
+		return
+	}
+	body := make([]byte, 0, len(callback)+len(bits)+3)
+	body = append(append(append(append(body, callback...), '('), bits...), ");"...)
+	rc.render(status, contentJavaScript, body)
+}
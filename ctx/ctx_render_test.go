@@ -0,0 +1,81 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"net/http"
+	"testing"
+)
+
+type renderItem struct {
+	Name string `json:"name" xml:"name"`
+	Tag  string `json:"tag" xml:"tag"`
+}
+
+func init() {
+	item := renderItem{Name: "rx", Tag: "<b>"}
+	for path, fn := range map[string]func(c ReqCxtI){
+		"json":     func(c ReqCxtI) { c.JSON(200, item) },
+		"pure":     func(c ReqCxtI) { c.PureJSON(200, item) },
+		"indented": func(c ReqCxtI) { c.IndentedJSON(200, map[string]int{"a": 1}) },
+		"jsonp":    func(c ReqCxtI) { c.JSONP(200, item) },
+		"xml":      func(c ReqCxtI) { c.XML(200, item) },
+		"string":   func(c ReqCxtI) { c.String(201, "hello %s", "rx") },
+		"percent":  func(c ReqCxtI) { c.String(200, "100%") },
+		"html":     func(c ReqCxtI) { c.HTMLString(200, "<p>rx</p>") },
+		"data":     func(c ReqCxtI) { c.Data(200, "image/png", []byte("\x89PNG")) },
+		"redirect": func(c ReqCxtI) { c.Redirect(302, "/render/json") },
+		"bad":      func(c ReqCxtI) { c.Redirect(200, "/render/json") },
+		"none":     func(c ReqCxtI) { c.NoContent(204) },
+		"marshal":  func(c ReqCxtI) { c.JSON(200, func() {}) },
+		"twice": func(c ReqCxtI) {
+			c.JSON(200, item)
+			c.String(202, "replaced")
+		},
+	} {
+		Register("get", "/render/"+path, fn)
+	}
+}
+
+func TestRender(t *testing.T) {
+	addr := serve(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, tc := range []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"json", 200, "application/json", `{"name":"rx","tag":"\u003cb\u003e"}`},
+		{"pure", 200, "application/json", `{"name":"rx","tag":"<b>"}`},
+		{"indented", 200, "application/json", "{\n    \"a\": 1\n}"},
+		{"jsonp?callback=app.cb", 200, "application/javascript; charset=utf-8", `app.cb({"name":"rx","tag":"\u003cb\u003e"});`},
+		{"jsonp?callback=alert(1)//", 200, "application/json", `{"name":"rx","tag":"\u003cb\u003e"}`},
+		{"xml", 200, "application/xml; charset=utf-8", `<renderItem><name>rx</name><tag>&lt;b&gt;</tag></renderItem>`},
+		{"string", 201, "text/plain; charset=utf-8", "hello rx"},
+		{"percent", 200, "text/plain; charset=utf-8", "100%"},
+		{"html", 200, "text/html; charset=utf-8", "<p>rx</p>"},
+		{"data", 200, "image/png", "\x89PNG"},
+		{"redirect", 302, "", ""},
+		{"bad", 500, "text/plain; charset=utf-8", "invalid redirect status"},
+		{"none", 204, "", ""},
+		{"marshal", 500, "text/plain; charset=utf-8", "marshal response failed"},
+		{"twice", 202, "text/plain; charset=utf-8", "replaced"},
+	} {
+		rsp, err := client.Get("http://" + addr + "/render/" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, rsp)
+		if rsp.StatusCode != tc.status || rsp.Header.Get("Content-Type") != tc.contentType || body != tc.body {
+			t.Fatalf("%s: %d %q %q", tc.path, rsp.StatusCode, rsp.Header.Get("Content-Type"), body)
+		}
+		if tc.path == "redirect" && rsp.Header.Get("Location") != "/render/json" {
+			t.Fatalf("location %q", rsp.Header.Get("Location"))
+		}
+	}
+}
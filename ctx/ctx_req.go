@@ -5,20 +5,18 @@
 package ctx
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/huaxr/rx/ctx/engine/alive"
+	"github.com/huaxr/rx/ctx/storage"
 
 	"github.com/huaxr/rx/internal"
 	"github.com/huaxr/rx/logger"
@@ -41,14 +39,88 @@ type ReqCxtI interface {
 	// to execute or jump to anther HandlerFunc to deal with the request.
 	Next(handlerFunc handlerFunc)
 
+	// ClientIP return the client ip, the X-Forwarded-For, X-Real-IP and
+	// Forwarded headers are honoured from the trusted proxies only.
+	ClientIP() string
+	// GetHeader return the first value of the request header.
+	GetHeader(key string) string
+	// Cookie return the value of the request cookie, http.ErrNoCookie
+	// is returned when it is absent.
+	Cookie(name string) (string, error)
+
+	// JSONP response wrapped in the function of the callback query,
+	// plain JSON without a valid callback.
+	JSONP(status int16, response interface{})
+	// Negotiate render the offer in the format the Accept header prefers,
+	// 406 when none is acceptable.
+	Negotiate(status int16, offer Offer)
+	// NegotiateFormat return the offered MIME type the Accept header
+	// prefers, the Abort messages are rendered in it.
+	NegotiateFormat(offered ...string) string
+
 	GetQuery(key, dft string) string
-	// ParseBody turn the body bytes to dst
+	GetQueryArray(key string) []string
+	// GetParam return the ":key" route param, e.g. Register("get", "/user/:id", h)
+	GetParam(key string) string
+	// ParseBody turn the body bytes to dst with the binder of the
+	// Content-Type, the request is aborted with 400 or 415 on failure.
 	ParseBody(dst interface{}) error
+	BindJSON(dst interface{}) error
+	BindXML(dst interface{}) error
+	BindForm(dst interface{}) error
+	BindWith(dst interface{}, b Binder) error
+	// BindQuery, BindHeader and BindURI bind the query string, headers
+	// and route params with the query, header and uri tags, the fields
+	// of each are validated by it.
+	BindQuery(dst interface{}) error
+	BindHeader(dst interface{}) error
+	BindURI(dst interface{}) error
+	// Validate validate the whole dst, e.g. after the Bind methods.
+	Validate(dst interface{}) error
 
 	// RegisterStrategy register the customized strategy
 	RegisterStrategy(strategy *StrategyContext)
 
-	SaveLocalFile(dst string)
+	// Request return the raw request
+	Request() *http.Request
+	// Body return the request body stream
+	Body() io.ReadCloser
+	// Decisions return the decisions made by the strategies
+	Decisions() []Decision
+
+	// Error record the error of the handler, the retry strategy
+	// retries the errored attempt.
+	Error(err error)
+	GetError() error
+	// MarkRetry mark the rest handlers as the sub-chain to retry.
+	MarkRetry()
+
+	// Deadline return the caller deadline parsed from the deadline header
+	Deadline() (time.Time, bool)
+	// Remaining return the remaining time budget to propagate downstream
+	Remaining() (time.Duration, bool)
+
+	// MultipartForm parse the multipart form within the limits of
+	// Config.Multipart, the errors are *BindError carrying the status.
+	MultipartForm() (*Form, error)
+	// File and Files return the uploaded files of the field.
+	File(field string) (*FormFile, error)
+	Files(field string) ([]*FormFile, error)
+	// Stream send the response incrementally with the chunked encoding,
+	// the writer is a Flusher.
+	Stream(step func(w io.Writer) bool)
+	// SSE respond with the event stream, the events are sent from any
+	// goroutine until the client is gone.
+	SSE() *EventStream
+	// FormValue return the value of the multipart or url encoded form.
+	FormValue(field string) string
+	// EachPart stream the multipart form part by part without buffering.
+	EachPart(fn func(p *Part) error) error
+	// SaveLocalFile save the file of the field into the dir, the existing
+	// file is not overwritten.
+	SaveLocalFile(field, dir string) (string, error)
+	// SaveFile save the file of the field to the storage after the hooks.
+	SaveFile(field string, s storage.Storage, key string, hooks ...UploadHook) (*storage.Object, error)
 }
 
 type mod int
@@ -60,6 +132,17 @@ const (
 	EPoll
 )
 
+const (
+	sentByHandlers int32 = iota + 1
+	sentByTimeout
+)
+
+// rawConn is the connection the response is written to.
+type rawConn interface {
+	io.Writer
+	RemoteAddr() net.Addr
+}
+
 // RequestContext contains all the engine when a req has triggered
 type RequestContext struct {
 	*responseContext
@@ -68,8 +151,8 @@ type RequestContext struct {
 	*StrategyContext
 
 	mod mod
-	// raw connection here when mod == Std
-	conn    net.Conn
+	// raw connection, the net.Conn of Std or the LoopConn of EPoll.
+	conn    rawConn
 	request *http.Request
 
 	// time request time time.now()
@@ -78,21 +161,82 @@ type RequestContext struct {
 
 	// stack record the executable func
 	stack *stack
+	// params of the matched route.
+	params []Param
+	// form the parsed multipart form.
+	form *Form
+	// continued sends the 100 Continue on the first read of the body.
+	continued *continueBody
+	// negotiated the format chosen by the NegotiateFormat.
+	negotiated string
+	// stream the steps of the streamed response.
+	stream func(w io.Writer) bool
+	// streamEnd is called once the stream ends or it's abandoned.
+	streamEnd func()
 
 	// abort will set the it true
 	// finished flag represent that the request has done.
 	finished bool
 
+	// decided flag represent the strategies of the registered
+	// StrategyContext have decided, the StrategyContext is shared by
+	// the requests.
+	decided bool
+	// ttl the Ttl of the registered StrategyContext counted down by
+	// this request.
+	ttl int32
+
+	// resume the step suspended until resumeAfter.
+	resume      func()
+	resumeAfter time.Duration
+
+	// sent by the handlers or the timeout, whichever comes first.
+	sent int32
+
+	// done is closed when the response has been sent, the response waits
+	// for the prev one of the pipelined requests.
+	done chan struct{}
+	prev <-chan struct{}
+	// streaming is closed once the stream of the std connection runs on
+	// its own goroutine.
+	streaming chan struct{}
+
+	// limiter admitted this request and waits for the release.
+	limiter *AdaptiveLimiter
+
+	// decisions made by the strategies.
+	decisions []Decision
+
+	// err recorded by the handlers.
+	err error
+	// retryMark the stack snapshot to retry from, attempts the retried count.
+	retryMark *mark
+	retryTtl  int32
+	attempts  int
+	// replay the body read by the attempt for the retry.
+	replay *replayBody
+
+	// bound the fields set by the Bind methods, their defaults are
+	// not taken again.
+	bound map[uintptr]bool
+
+	// deadline of the caller parsed from the deadline header.
+	deadline time.Time
+	// expire the timeout signal of the request at the expires, the
+	// Timeout of the strategy tightened to the deadline.
+	expire  <-chan time.Time
+	expires time.Time
+
 	// whether this connection is alive
 	// conn will not close when keepalive set.
-	//keepalive bool
+	keepAlive bool
 }
 
 var reqCtxPool = sync.Pool{
 	New: func() interface{} {
 		return &RequestContext{
 			responseContext: &responseContext{
-				rspHeaders: make(map[string]interface{}),
+				rspHeaders: make(http.Header),
 				rspBody:    []byte{},
 				body:       bytes.Buffer{},
 			},
@@ -110,9 +254,9 @@ func (r *RequestContext) setAbort(status int16, message interface{}) {
 	r.status = status
 	switch message.(type) {
 	default:
-		r.responseContext.rspHeaders["Content-Type"] = internal.MIMEHTML
+		r.responseContext.rspHeaders.Set("Content-Type", internal.MIMEHTML)
 	case map[string]interface{}:
-		r.responseContext.rspHeaders["Content-Type"] = internal.MIMEJSON
+		r.responseContext.rspHeaders.Set("Content-Type", internal.MIMEJSON)
 	}
 	r.abortContext = r.NewAbort(status, message)
 	r.finished = true
@@ -128,9 +272,36 @@ func (r *RequestContext) free() *RequestContext {
 	r.StrategyContext = nil
 	// if the openStrategy did not set false, it will trigger nil pointer
 	// at next Get from the sync.Pool, because the flag not clear automatically when put to sync.Pool.
-	r.rspHeaders = map[string]interface{}{}
+	r.rspHeaders = http.Header{}
 	r.flashStore = &sync.Map{}
 	r.finished = false
+	r.decided = false
+	r.ttl = 0
+	r.resume = nil
+	atomic.StoreInt32(&r.sent, 0)
+	r.limiter = nil
+	r.decisions = nil
+	r.err = nil
+	r.retryMark = nil
+	r.retryTtl = 0
+	r.attempts = 0
+	r.replay = nil
+	r.bound = nil
+	r.deadline = time.Time{}
+	r.expire = nil
+	r.expires = time.Time{}
+	r.keepAlive = false
+	r.prev = nil
+	r.streaming = nil
+	r.params = nil
+	r.continued = nil
+	r.negotiated = ""
+	r.stream = nil
+	r.streamEnd = nil
+	if r.form != nil {
+		r.form.removeAll()
+		r.form = nil
+	}
 	return r
 }
 
@@ -138,9 +309,10 @@ func (r *RequestContext) init() {
 	r.time = time.Now()
 	r.finished = false
 	r.flashStore = new(sync.Map)
+	r.done = make(chan struct{})
 }
 
-// http read need readTimeout to check whether the connection
+// read the tcp data, readTimeout check whether the connection
 // data is already received.
 func read(conn net.Conn, readTimeout bool) *bytes.Buffer {
 	var buffer bytes.Buffer
@@ -179,32 +351,140 @@ func read(conn net.Conn, readTimeout bool) *bytes.Buffer {
 	return &buffer
 }
 
-func executeHttp(conn net.Conn) {
-	buffer := read(conn, true)
-	if buffer == nil {
-		return
+// executeHttp serve the requests of the connection. a persistent
+// connection is parked after the response until the next request
+// arrives, then dispatch hands it back to the workers, so that an
+// idle connection does not hold a worker. a nil dispatch serves the
+// connection in the current goroutine.
+func executeHttp(conn net.Conn, dispatch func(net.Conn)) {
+	sc, ok := conn.(*stdConn)
+	if !ok {
+		sc = newStdConn(conn)
+		if getConfig().ProxyProtocol {
+			if err := sc.readProxy(); err != nil {
+				logger.Log.Warning("proxy protocol from %s: %v", conn.RemoteAddr(), err)
+				_ = sc.Close()
+				return
+			}
+		}
 	}
-	if buffer.Len() == 0 {
-		return
+	serveConn(sc, dispatch)
+}
+
+// serveConn serve the requests of the connection until it's closed or
+// parked for the dispatch. the streamed response takes the connection
+// over, it's served on once the stream ends.
+func serveConn(sc *stdConn, dispatch func(net.Conn)) {
+	for {
+		keep, streamed := serveHttp(sc, dispatch)
+		if streamed || !keepServing(sc, keep, dispatch) {
+			return
+		}
 	}
-	reqCtx := reqCtxPool.Get().(*RequestContext)
-	defer func() {
-		// return back the context poll
-		putContext(reqCtx)
-		buffer.Reset()
-	}()
+}
 
-	reqCtx.init()
-	reqCtx.setMod(Std)
-	reqCtx.setRawSock(conn)
+// keepServing park the kept connection for the dispatch or wait for its
+// next request, return false once it's not served by the caller.
+func keepServing(sc *stdConn, keep bool, dispatch func(net.Conn)) bool {
+	switch {
+	case !keep:
+		_ = sc.Close()
+		return false
+	case dispatch != nil:
+		go sc.park(dispatch)
+		return false
+	case !sc.waitIdle():
+		_ = sc.Close()
+		return false
+	}
+	return true
+}
 
-	r, err := http.ReadRequest(bufio.NewReader(buffer))
-	reqCtx.setRequest(r)
+// serveHttp serve the requests of the connection until it's idle,
+// return whether the connection is kept alive, or it's streamed and
+// served on by the stream. the pipelined requests without body are read
+// ahead while the previous ones are pending, their responses are written
+// in request order.
+func serveHttp(sc *stdConn, dispatch func(net.Conn)) (keep, streamed bool) {
+	for {
+		r, err := sc.readRequest()
+		status, message := int16(0), ""
+		if err != nil {
+			if status, message = readErrStatus(err); status == 0 {
+				sc.wait()
+				return false, false
+			}
+		}
 
-	if err != nil {
-		reqCtx.setAbort(400, "only allowed http.")
+		reqCtx := reqCtxPool.Get().(*RequestContext)
+		reqCtx.init()
+		reqCtx.setMod(Std)
+		reqCtx.setRawSock(sc)
+		reqCtx.setRequest(r)
+		reqCtx.keepAlive = err == nil && sc.keepAlive(r)
+		reqCtx.prev = sc.last
+		sc.last = reqCtx.done
+		reqCtx.streaming = make(chan struct{})
+		if status != 0 {
+			reqCtx.setAbort(status, message)
+		} else if !reqCtx.rejectEarly() {
+			reqCtx.expectContinue()
+			reqCtx.decompress()
+		}
+
+		sc.acquire()
+		reqCtx.execute()
+		// the dispatch worker is not held for the long stream, it serves
+		// the connection on once it ends.
+		streamOn := func() {
+			go func() {
+				<-reqCtx.done
+				if keepServing(sc, sc.sent(reqCtx, r), dispatch) {
+					serveConn(sc, dispatch)
+				}
+			}()
+		}
+		select {
+		case <-reqCtx.streaming:
+			streamOn()
+			return false, true
+		default:
+		}
+		if reqCtx.keepAlive && sc.pipelined(r) {
+			// the detached stack owns the context until the response is sent.
+			go func() {
+				<-reqCtx.done
+				sc.release()
+				if reqCtx.abandoned() {
+					_ = sc.Close()
+					return
+				}
+				putContext(reqCtx)
+			}()
+			continue
+		}
+		select {
+		case <-reqCtx.done:
+		case <-reqCtx.streaming:
+			streamOn()
+			return false, true
+		}
+		return sc.sent(reqCtx, r), false
+	}
+}
+
+// sent release the context of the response sent, return whether the
+// connection is kept alive.
+func (sc *stdConn) sent(rc *RequestContext, r *http.Request) bool {
+	sc.release()
+	if rc.abandoned() {
+		// the handlers still own the context.
+		return false
 	}
-	reqCtx.execute()
+	keep := rc.keepAlive && sc.drain(r)
+	// return back the context poll
+	putContext(rc)
+	return keep
 }
 
 // alive set the net.conn to the tcpConn
@@ -245,33 +525,26 @@ func executeTcp(conn net.Conn) {
 }
 
 func WrapStd(conn net.Conn, typ string) {
+	ServeStd(conn, typ, nil)
+}
+
+// ServeStd serve the connection of the std engine as the WrapStd,
+// dispatch is called with the persistent http connection once it's next
+// request arrives.
+func ServeStd(conn net.Conn, typ string, dispatch func(net.Conn)) {
 	switch typ {
 	case "tcp":
 		executeTcp(conn)
 	case "http":
-		executeHttp(conn)
-	}
-}
-
-func WapEPoll(buf []byte) []byte {
-	reqCtx := reqCtxPool.Get().(*RequestContext)
-	reqCtx.init()
-	reqCtx.setMod(EPoll)
-	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return nil
+		executeHttp(conn, dispatch)
 	}
-	reqCtx.request = r
-	res := reqCtx.execute()
-	return res.rspBody
 }
 
 func (rc *RequestContext) setMod(m mod) {
 	rc.mod = m
 }
 
-func (rc *RequestContext) setRawSock(c net.Conn) {
+func (rc *RequestContext) setRawSock(c rawConn) {
 	rc.conn = c
 }
 
@@ -279,6 +552,17 @@ func (rc *RequestContext) setRequest(req *http.Request) {
 	rc.request = req
 }
 
+func (rc *RequestContext) Request() *http.Request {
+	return rc.request
+}
+
+func (rc *RequestContext) Body() io.ReadCloser {
+	if rc.request == nil || rc.request.Body == nil {
+		return http.NoBody
+	}
+	return rc.request.Body
+}
+
 func (rc *RequestContext) GetMethod() string {
 	if rc.request == nil {
 		return ""
@@ -296,20 +580,27 @@ func (rc *RequestContext) GetPath() string {
 func (rc *RequestContext) finish() {
 	rc.SetStopTime(time.Now())
 	rc.finished = true
+	rc.releaseLimiter()
 	logger.ReqLog(&internal.RequestLogger{
 		StartTime: rc.time,
 		StopTime:  rc.responseContext.time,
-		Ip:        rc.conn.RemoteAddr().String(),
+		Ip:        rc.ClientIP(),
 		Method:    rc.GetMethod(),
 		Path:      rc.GetPath(),
 		Status:    rc.status,
 	})
-	_ = rc.conn.Close()
+}
+
+func (rc *RequestContext) releaseLimiter() {
+	if rc.limiter != nil {
+		rc.limiter.release(rc.getPathKey(), rc.responseContext.time.Sub(rc.time))
+		rc.limiter = nil
+	}
 }
 
 func (rc *RequestContext) checkAbort() bool {
 	if rc.isAbort() {
-		rc.responseContext.rspBody = rc.abortContext.GetAbortMessage()
+		rc.renderAbort()
 		return true
 	}
 	return false
@@ -323,98 +614,142 @@ func (rc *RequestContext) isEPoll() bool {
 	return rc.mod == EPoll
 }
 
-func (rc *RequestContext) setMemorySize(size int64) {
-	err := rc.request.ParseMultipartForm(size)
-	if err != nil {
-		logger.Log.Error(err.Error())
+// connSend serialize the response and write it after the response of
+// the previous pipelined request, done is closed once it's written.
+func (rc *RequestContext) connSend() {
+	if rc.request != nil && rc.continuePending() {
+		rc.keepAlive = false
+	}
+	switch {
+	case rc.request == nil || !rc.keepAlive:
+		rc.rspHeaders.Set("Connection", "close")
+	case rc.request.ProtoAtLeast(1, 1):
+	default:
+		// HTTP/1.0 persistent connection must be announced.
+		rc.rspHeaders.Set("Connection", "keep-alive")
+	}
+	if rc.stream != nil && !rc.isAbort() {
+		rc.sendStream()
+		return
+	}
+	rc.endStream()
+	rc.compressBody()
+	head := rc.request != nil && rc.request.Method == http.MethodHead
+	response := rc.responseContext.wrapResponse(head)
+	rc.finish()
+	rc.write(response)
+}
+
+// sendTimeout answer 504 without waiting for the handlers, the response
+// is built apart from the context they still write. the context is theirs
+// then, it's not put back to the pool, and the connection closes after
+// the response, they may be reading the body.
+func (rc *RequestContext) sendTimeout() {
+	if !atomic.CompareAndSwapInt32(&rc.sent, 0, sentByTimeout) {
 		return
 	}
+	rsp := &responseContext{status: 504, rspHeaders: http.Header{}, rspBody: []byte("deadline exceeded")}
+	rsp.rspHeaders.Set("Content-Type", internal.MIMEPlain)
+	rsp.rspHeaders.Set("Connection", "close")
+	head := rc.request != nil && rc.request.Method == http.MethodHead
+	response := rsp.wrapResponse(head)
+	logger.ReqLog(&internal.RequestLogger{
+		StartTime: rc.time,
+		StopTime:  time.Now(),
+		Ip:        rc.ClientIP(),
+		Method:    rc.GetMethod(),
+		Path:      rc.GetPath(),
+		Status:    504,
+	})
+	rc.write(response)
 }
 
-func (rc *RequestContext) GetFileName() string {
-	_, header, err := rc.request.FormFile("file")
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return ""
-	}
-	return header.Filename
+// claim report whether the handlers send the response, the timeout may
+// have answered already.
+func (rc *RequestContext) claim() bool {
+	return atomic.CompareAndSwapInt32(&rc.sent, 0, sentByHandlers)
 }
 
-func (rc *RequestContext) GetFile() multipart.File {
-	file, _, err := rc.request.FormFile("file")
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return nil
-	}
-	return file
+// abandoned report whether the timeout answered while the handlers go on.
+func (rc *RequestContext) abandoned() bool {
+	return atomic.LoadInt32(&rc.sent) == sentByTimeout
 }
 
-func (rc *RequestContext) SaveLocalFile(dst string) {
-	file, header, err := rc.request.FormFile("file")
-	if err != nil {
-		log.Println(err, rc.conn)
-		return
-	}
-	path := dst + "/" + header.Filename
-	cur, err := os.Create(path)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return
-	}
-	defer cur.Close()
-	_, err = io.Copy(cur, file)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return
+// write the response after the previous one, done is closed once it's
+// written.
+func (rc *RequestContext) write(response []byte) {
+	w, prev, done := rc.conn, rc.prev, rc.done
+	write := func() {
+		if prev != nil {
+			<-prev
+		}
+		_, _ = w.Write(response)
+		close(done)
 	}
-	fi, err := os.Stat(path)
-	if err != nil {
-		logger.Log.Error(err.Error())
+	// the epoll loop must not wait for the pending previous response.
+	if rc.isEPoll() && prev != nil && !isClosed(prev) {
+		go write()
 		return
 	}
-	fmt.Println("file size is ", fi.Size(), err)
+	write()
 }
 
-func (rc *RequestContext) connSend() {
-	if !rc.isStd() {
-		return
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
 	}
-	response := rc.responseContext.wrapResponse()
-	rc.conn.Write(response)
 }
 
 func (rc *RequestContext) asyncExecute(async chan struct{}) {
 	defer func() {
-		rc.checkAbort()
-		rc.finish()
-		rc.connSend()
+		if rc.claim() {
+			rc.checkAbort()
+			rc.connSend()
+		} else {
+			// the timeout answered, the latency is still observed.
+			rc.SetStopTime(time.Now())
+			rc.releaseLimiter()
+		}
 		close(async)
 	}()
 
 	// response data received
-	for rc.stack.length.Load() > 0 {
-		// demanding processing should be using handlerFunc() to return
-		// a chan bool to notify whether this stack has been down.
-		h := rc.stack.Pop()
-		h(rc)
-
-		if rc.isAbort() || rc.finished {
-			// if asyncSignal equals nil, this goroutine
-			// will perpetual block eternal die, which will
-			// cause memory leak, using runtime.NumGoroutine
-			// to debug this.
-			async <- struct{}{}
-			return
+	for {
+		for rc.running() {
+			// demanding processing should be using handlerFunc() to return
+			// a chan bool to notify whether this stack has been down.
+			h := rc.stack.Pop()
+			h(rc)
+
+			if rc.isAbort() || rc.finished {
+				// running retries or stops.
+				continue
+			}
+			// handle ttl here
+			if rc.ttl == 0 {
+				rc.handleTTL(rc)
+				break
+			}
+			// stack execute once. ttl -= 1
+			rc.decTTL()
 		}
-		// handle ttl here
-		if rc.Ttl == 0 {
-			rc.handleTTL(rc)
-			async <- struct{}{}
-			return
+		// the backoff of the retry is waited on this goroutine of its own.
+		step := rc.resume
+		if step == nil {
+			break
 		}
-		// stack execute once. ttl -= 1
-		rc.decTTL()
+		rc.resume = nil
+		time.Sleep(rc.resumeAfter)
+		step()
 	}
+	// if asyncSignal equals nil, this goroutine
+	// will perpetual block eternal die, which will
+	// cause memory leak, using runtime.NumGoroutine
+	// to debug this.
+	async <- struct{}{}
 }
 
 // the ctx handler invoke and trigger some events in each handler.
@@ -422,23 +757,51 @@ func (rc *RequestContext) asyncExecute(async chan struct{}) {
 // choice for your logic flow. stack HandlerFunc can using
 // the dynamic push option to return a HandlerFunc to the
 // stack peek and execute it when next pop.
-func (rc *RequestContext) execute() (response *responseContext) {
+func (rc *RequestContext) execute() {
+	rc.run(func() {
+		// initStack will set the *stack and abort status.
+		rc.initStack()
+		rc.initDeadline()
+	})
+}
+
+// suspend hand the stack to a timer, the step and the rest of the stack
+// run once it fires. the goroutine executing the handlers, the epoll
+// loop included, is not blocked meanwhile.
+func (rc *RequestContext) suspend(d time.Duration, step func()) {
+	rc.resume, rc.resumeAfter = step, d
+}
+
+// run the step then the stack, the response is sent unless the stack is
+// handed to a goroutine or a timer.
+func (rc *RequestContext) run(step func()) {
+	// detached represent that the stack is handed to a goroutine, which
+	// takes charge of sending the response. the context is not touched
+	// then, it may be put back to the pool already.
+	detached := false
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Log.Recovery(internal.BytesToString(internal.PrintStack()))
 		}
-		if rc.StrategyContext != nil && (rc.Async || rc.timeout) {
+		if detached {
+			return
+		}
+		// the timer starts last, the context belongs to it then.
+		if step := rc.resume; step != nil {
+			rc.resume = nil
+			time.AfterFunc(rc.resumeAfter, func() { rc.run(step) })
 			return
 		}
 		rc.checkAbort()
-		response = rc.responseContext
 		rc.connSend()
-		rc.finish()
 	}()
-	// initStack will set the *stack and abort status.
-	rc.initStack()
+	step()
+	if rc.resume != nil {
+		return
+	}
 	// not abort, not finished check with the available stack.
-	for !rc.isAbort() && !rc.finished && rc.stack.length.Load() > 0 {
+	// the retry strategy restores the stack of a retryable attempt.
+	for rc.running() {
 		// not using strategy.
 		if rc.StrategyContext == nil {
 			rc.stack.Pop()(rc)
@@ -446,28 +809,32 @@ func (rc *RequestContext) execute() (response *responseContext) {
 			//if rc.Demotion != nil {
 			//	rc.Demotion.Do()
 			//}
-			// stop and set abort whether score a hit of the Fusing.Do() method.
-			if rc.Fusing != nil && rc.Fusing.Do() {
-				rc.setAbort(403, "fusing deny")
-				return
-			}
-
-			if rc.Security != nil && rc.Security.Do() {
-				rc.setAbort(403, "security deny")
-				return
+			// the strategies decide once for each registered StrategyContext,
+			// the loop stops when it's denied and goes on the rerouted stack.
+			if !rc.decided {
+				rc.decided = true
+				rc.decide()
+				// the Delay suspended the rest of the decisions.
+				if rc.resume != nil {
+					return
+				}
+				continue
 			}
 
 			// using timeout. using async, ttl...
-			if rc.timeout {
+			if rc.expire != nil {
 				done := make(chan struct{}, 1)
 				// done channel with buffer, attention here.
 				// if no buffer here, some goroutines will
 				// deadly block in the end.
+				detached = true
+				// the handlers may register another strategy meanwhile.
+				s, expire := rc.StrategyContext, rc.expire
 				go rc.asyncExecute(done)
 				select {
 				case <-done:
-				case <-rc.timeoutSignal:
-					rc.handleTimeOut(rc)
+				case <-expire:
+					s.handleTimeOut(rc)
 				}
 				return
 			}
@@ -476,12 +843,13 @@ func (rc *RequestContext) execute() (response *responseContext) {
 				done := make(chan struct{}, 1)
 				// chan with buffer, otherwise block.
 				// todo: using goroutine pool to manager the counts.
+				detached = true
 				go rc.asyncExecute(done)
 				return
 			}
 
 			rc.stack.Pop()(rc)
-			if rc.Ttl == 0 {
+			if rc.ttl == 0 {
 				rc.handleTTL(rc)
 				return
 			}
@@ -560,6 +928,12 @@ func (rc *RequestContext) initStack() {
 	}
 	key := rc.getPathKey()
 	handles = copyStack(key)
+	if handles == nil {
+		if r, params := matchRouter(rc.request.Method, rc.GetPath()); r != nil {
+			handles = routerStack(r)
+			rc.params = params
+		}
+	}
 	if handles == nil {
 		handles = newStack()
 		handles.Push(defaultHANDLERS[404])
@@ -571,27 +945,76 @@ func (rc *RequestContext) getPathKey() string {
 	return fmt.Sprintf("%s::", strings.ToLower(rc.request.Method)) + rc.GetPath()
 }
 
-func (rc *RequestContext) ParseBody(dst interface{}) error {
-	return nil
-}
-
 func (rc *RequestContext) GetQuery(key, dft string) string {
 	res, ok := rc.request.URL.Query()[key]
-	if !ok {
+	if !ok || len(res) == 0 {
 		return dft
 	}
 	return res[0]
 }
 
+func (rc *RequestContext) GetHeader(key string) string {
+	return rc.request.Header.Get(key)
+}
+
+func (rc *RequestContext) Cookie(name string) (string, error) {
+	c, err := rc.request.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return c.Value, nil
+}
+
+// GetQueryArray return every value of the key, e.g. ?tag=a&tag=b.
+func (rc *RequestContext) GetQueryArray(key string) []string {
+	return rc.request.URL.Query()[key]
+}
+
+// GetParam return the value of the ":key" segment of the route.
+func (rc *RequestContext) GetParam(key string) string {
+	for _, p := range rc.params {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
 func (rc *RequestContext) Abort(status int16, message interface{}) {
 	rc.setAbort(status, message)
 }
 
+// SetTTL the stack of the request is inc 1 to the t set.
+func (rc *RequestContext) SetTTL(t int32) {
+	if t < 0 {
+		return
+	}
+	rc.ttl = t + 1
+}
+
+func (rc *RequestContext) decTTL() {
+	if rc.ttl == 0 {
+		return
+	}
+	rc.ttl -= 1
+}
+
 func (rc *RequestContext) RegisterStrategy(strategy *StrategyContext) {
 	if strategy == nil {
 		strategy = openDefaultStrategy()
-	} else {
-		strategy.wrapDefault()
 	}
 	rc.StrategyContext = strategy
+	rc.decided = false
+	// the strategy is shared by the requests, the Ttl and the Timeout
+	// are counted on the request.
+	rc.ttl = strategy.maxTTL()
+	rc.expire = nil
+	if strategy.Timeout > 0 {
+		rc.expireAt(time.Now().Add(strategy.Timeout))
+	}
+	rc.tightenTimeout()
+	if strategy.Retry != nil {
+		rc.markRetry()
+		rc.recordBody()
+	}
 }
@@ -0,0 +1,242 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/huaxr/rx/internal"
+)
+
+// RetryPolicy re-executes the handler chain of the route when an attempt
+// ends with a retryable status or an error recorded by c.Error.
+// the whole chain is retried by default, call c.MarkRetry in a handler
+// to retry the sub-chain after it only.
+type RetryPolicy struct {
+	// MaxAttempts including the first one, default 3.
+	MaxAttempts int
+	// BaseDelay and MaxDelay of the exponential backoff with jitter,
+	// default 50ms and 1s.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Budget the total time of all the attempts from the request start,
+	// it's tightened by the Timeout of the strategy.
+	Budget time.Duration
+	// Statuses retryable, default 502, 503 and 504.
+	Statuses []int16
+	// NonIdempotent retries the POST, PATCH and CONNECT requests too.
+	NonIdempotent bool
+	// MaxBodySize the request body recorded to be replayed by the next
+	// attempt, the request reading more is not retried, default 1MB.
+	MaxBodySize int64
+}
+
+var defaultRetryStatuses = []int16{502, 503, 504}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case internal.MethodGet, internal.MethodHead, internal.MethodOptions,
+		internal.MethodTrace, internal.MethodPut, internal.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+// backoff return the delay before the attempt, full jitter on the
+// upper half of the exponential delay.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = 50 * time.Millisecond
+	}
+	if max <= 0 {
+		max = time.Second
+	}
+	d := base << uint(attempt-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (p *RetryPolicy) maxBodySize() int64 {
+	if p.MaxBodySize <= 0 {
+		return 1 << 20
+	}
+	return p.MaxBodySize
+}
+
+func (p *RetryPolicy) retryable(rc *RequestContext) bool {
+	if rc.request == nil || (!p.NonIdempotent && !isIdempotent(rc.request.Method)) {
+		return false
+	}
+	// the body read is lost without the replay.
+	if rc.replay != nil && rc.replay.over {
+		return false
+	}
+	// denied by the strategies, it's not the handlers' failure.
+	if n := len(rc.decisions); n > 0 && rc.decisions[n-1].Action == Deny {
+		return false
+	}
+	if rc.err != nil {
+		return true
+	}
+	statuses := p.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	for _, s := range statuses {
+		if rc.status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// deadline of the retries, the smallest of the Budget, the Timeout
+// and the caller deadline.
+func (rc *RequestContext) retryDeadline() (time.Time, bool) {
+	deadline := rc.deadline
+	if rc.Retry.Budget > 0 {
+		if t := rc.time.Add(rc.Retry.Budget); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if rc.expire != nil && (deadline.IsZero() || rc.expires.Before(deadline)) {
+		deadline = rc.expires
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// retry return the backoff before the next attempt when the finished
+// attempt is retryable, false when the request is done.
+func (rc *RequestContext) retry() (time.Duration, bool) {
+	if rc.StrategyContext == nil || rc.Retry == nil || rc.retryMark == nil {
+		return 0, false
+	}
+	if !rc.Retry.retryable(rc) {
+		return 0, false
+	}
+	rc.attempts++
+	if rc.attempts >= rc.Retry.maxAttempts() {
+		return 0, false
+	}
+	delay := rc.Retry.backoff(rc.attempts)
+	if deadline, ok := rc.retryDeadline(); ok && time.Now().Add(delay).After(deadline) {
+		return 0, false
+	}
+	return delay, true
+}
+
+// rewind reset the response, the stack and the body for the next attempt.
+func (rc *RequestContext) rewind() {
+	rc.resetResponse()
+	rc.stack.Reset(*rc.retryMark)
+	if rc.replay != nil {
+		rc.replay.rewind()
+		rc.request.Body = rc.replay
+	}
+}
+
+// running report whether the stack goes on, the retryable attempt
+// finished is suspended for the backoff and goes on from the mark.
+func (rc *RequestContext) running() bool {
+	if !rc.isAbort() && !rc.finished && rc.stack.Len() > 0 {
+		return true
+	}
+	if delay, ok := rc.retry(); ok {
+		rc.suspend(delay, rc.rewind)
+	}
+	return false
+}
+
+// resetResponse clear the response state of the failed attempt.
+func (rc *RequestContext) resetResponse() {
+	rc.status = 0
+	rc.rspBody = rc.rspBody[:0]
+	rc.rendered = false
+	rc.endStream()
+	rc.stream = nil
+	rc.rspHeaders = http.Header{}
+	rc.abortContext = nil
+	rc.finished = false
+	rc.err = nil
+	rc.ttl = rc.retryTtl
+}
+
+// markRetry snapshot the rest of the stack and the Ttl, the retry goes
+// on from there, the strategy registered is not registered again.
+func (rc *RequestContext) markRetry() {
+	m := rc.stack.Mark()
+	rc.retryMark = &m
+	rc.retryTtl = rc.ttl
+}
+
+func (rc *RequestContext) MarkRetry() {
+	rc.markRetry()
+}
+
+// recordBody record the body read for the replay of the retries.
+func (rc *RequestContext) recordBody() {
+	if rc.replay != nil || rc.request == nil || rc.request.Body == nil || rc.request.Body == http.NoBody {
+		return
+	}
+	rc.replay = &replayBody{body: rc.request.Body, max: rc.Retry.maxBodySize()}
+	rc.request.Body = rc.replay
+}
+
+// replayBody record the bytes read up to the max, the next attempt reads
+// them again before the rest of the body.
+type replayBody struct {
+	body io.ReadCloser
+	buf  []byte
+	pos  int
+	max  int64
+	over bool
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	if b.pos < len(b.buf) {
+		n := copy(p, b.buf[b.pos:])
+		b.pos += n
+		return n, nil
+	}
+	n, err := b.body.Read(p)
+	if n > 0 && !b.over {
+		if int64(len(b.buf)+n) > b.max {
+			b.over, b.buf, b.pos = true, nil, 0
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+			b.pos = len(b.buf)
+		}
+	}
+	return n, err
+}
+
+func (b *replayBody) rewind() {
+	b.pos = 0
+}
+
+func (b *replayBody) Close() error {
+	return b.body.Close()
+}
+
+func (rc *RequestContext) Error(err error) {
+	rc.err = err
+}
+
+func (rc *RequestContext) GetError() error {
+	return rc.err
+}
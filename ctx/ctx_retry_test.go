@@ -0,0 +1,180 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// retryCounts the registrations and the attempts of each request id.
+var retryCounts = struct {
+	sync.Mutex
+	registered map[string]int
+	attempts   map[string]int
+}{registered: map[string]int{}, attempts: map[string]int{}}
+
+func retryAttempt(c ReqCxtI) int {
+	retryCounts.Lock()
+	defer retryCounts.Unlock()
+	retryCounts.attempts[c.GetQuery("id", "")]++
+	return retryCounts.attempts[c.GetQuery("id", "")]
+}
+
+func init() {
+	retryStrategy := func(c ReqCxtI) {
+		retryCounts.Lock()
+		retryCounts.registered[c.GetQuery("id", "")]++
+		retryCounts.Unlock()
+		base := 5 * time.Millisecond
+		if c.GetQuery("slow", "") != "" {
+			base = 200 * time.Millisecond
+		}
+		c.RegisterStrategy(&StrategyContext{Ttl: 3, Retry: &RetryPolicy{
+			MaxAttempts:   3,
+			BaseDelay:     base,
+			NonIdempotent: true,
+			MaxBodySize:   16,
+		}})
+	}
+	// the Ttl of each attempt is 3, the two handlers take two of it.
+	Register("get", "/retry/flaky", retryStrategy, func(c ReqCxtI) {
+		c.Set("first", true)
+	}, func(c ReqCxtI) {
+		if n := retryAttempt(c); n < 3 {
+			c.String(503, "attempt %d", n)
+			return
+		}
+		c.String(200, "ok")
+	})
+	Register("post", "/retry/body", retryStrategy, func(c ReqCxtI) {
+		b, _ := ioutil.ReadAll(c.Body())
+		if n := retryAttempt(c); n < 2 {
+			c.String(503, "attempt %d", n)
+			return
+		}
+		c.String(200, "%s", b)
+	})
+}
+
+// sharedRetry is registered by every request of the route.
+var sharedRetry = &StrategyContext{Ttl: 3, Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+
+func init() {
+	Register("get", "/retry/shared", func(c ReqCxtI) {
+		c.RegisterStrategy(sharedRetry)
+	}, func(c ReqCxtI) {
+		c.Set("first", true)
+	}, func(c ReqCxtI) {
+		if n := retryAttempt(c); n%2 == 1 {
+			c.String(503, "attempt %d", n)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.String(200, "ok")
+	})
+}
+
+func resetRetryCounts() {
+	retryCounts.Lock()
+	defer retryCounts.Unlock()
+	retryCounts.registered = map[string]int{}
+	retryCounts.attempts = map[string]int{}
+}
+
+func TestRetry(t *testing.T) {
+	resetRetryCounts()
+	addr := serve(t)
+	rsp, err := http.Get("http://" + addr + "/retry/flaky?id=flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, rsp); rsp.StatusCode != 200 || body != "ok" {
+		t.Fatalf("retried response %d %q", rsp.StatusCode, body)
+	}
+	retryCounts.Lock()
+	defer retryCounts.Unlock()
+	// the retries go on after the strategy registered.
+	if retryCounts.attempts["flaky"] != 3 || retryCounts.registered["flaky"] != 1 {
+		t.Fatalf("attempts %d, registered %d", retryCounts.attempts["flaky"], retryCounts.registered["flaky"])
+	}
+}
+
+func TestRetryBody(t *testing.T) {
+	resetRetryCounts()
+	addr := serve(t)
+	for _, tc := range []struct {
+		id, body string
+		status   int
+		want     string
+		attempts int
+	}{
+		// the body read by the first attempt is replayed.
+		{"short", "replayed", 200, "replayed", 2},
+		// the body over the MaxBodySize is not retried.
+		{"long", strings.Repeat("x", 32), 503, "attempt 1", 1},
+	} {
+		rsp, err := http.Post("http://"+addr+"/retry/body?id="+tc.id, "text/plain", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || body != tc.want {
+			t.Fatalf("%s: %d %q", tc.id, rsp.StatusCode, body)
+		}
+		retryCounts.Lock()
+		attempts := retryCounts.attempts[tc.id]
+		retryCounts.Unlock()
+		if attempts != tc.attempts {
+			t.Fatalf("%s: attempts %d", tc.id, attempts)
+		}
+	}
+}
+
+func TestEPollRetryBackoff(t *testing.T) {
+	resetRetryCounts()
+	lc := &loopConn{closed: make(chan struct{})}
+	start := time.Now()
+	NewEPollConn(lc).Serve([]byte("GET /retry/flaky?id=epoll&slow=1 HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	// the backoff is not waited on the loop.
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Fatalf("the loop blocked %v", elapsed)
+	}
+	select {
+	case <-lc.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, rsp); body != "ok" {
+		t.Fatalf("retried response %q", body)
+	}
+}
+
+func TestRetrySharedStrategy(t *testing.T) {
+	resetRetryCounts()
+	addr := serve(t)
+	// the Ttl of the strategy is counted by each request and each attempt.
+	for i := 0; i < 8; i++ {
+		rsp, err := http.Get("http://" + addr + "/retry/shared?id=shared" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != 200 || body != "ok" {
+			t.Fatalf("request %d: %d %q", i, rsp.StatusCode, body)
+		}
+	}
+	if sharedRetry.Ttl != 3 {
+		t.Fatalf("strategy Ttl %d", sharedRetry.Ttl)
+	}
+}
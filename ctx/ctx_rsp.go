@@ -6,26 +6,67 @@ package ctx
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/huaxr/rx/logger"
-
-	"github.com/huaxr/rx/internal"
 )
 
+// RspCtxI renders the response. the body is committed by the last
+// render, a render replaces the body of the previous one.
 type RspCtxI interface {
 	// JSON response
 	JSON(status int16, response interface{})
+	// PureJSON response without escaping the HTML characters.
+	PureJSON(status int16, response interface{})
+	// IndentedJSON response indented for the human reader.
+	IndentedJSON(status int16, response interface{})
+	// XML response
+	XML(status int16, response interface{})
+	// String response of the formatted text, the format is taken as it
+	// is without values.
+	String(status int16, format string, values ...interface{})
+	// HTML response of the template loaded by the LoadTemplates.
+	HTML(status int16, name string, data interface{})
+	// HTMLString response of the raw html.
+	HTMLString(status int16, html string)
+	// Data response of the bytes with the content type.
+	Data(status int16, contentType string, data []byte)
+	// Redirect to the location with the 3xx status.
+	Redirect(status int16, location string)
+	// NoContent response without body, e.g. 204.
+	NoContent(status int16)
+	// Status set the status of the response without body.
+	Status(status int16)
+
+	// SetHeader replace the values of the response header.
+	SetHeader(key, value string)
+	// AddHeader append the value to the response header.
+	AddHeader(key, value string)
+	DelHeader(key string)
+	// SetCookie append the Set-Cookie header of the cookie.
+	SetCookie(cookie *Cookie)
+}
+
+// Cookie is the http.Cookie with the Partitioned attribute.
+type Cookie struct {
+	http.Cookie
+	// Partitioned stores the cookie in the partitioned storage of the
+	// top level site, it requires Secure.
+	Partitioned bool
 }
 
 type responseContext struct {
 	body bytes.Buffer
 
-	rspHeaders map[string]interface{}
+	rspHeaders http.Header
 	rspBody    []byte
 	status     int16
+	// rendered the body is committed by a render.
+	rendered bool
 
 	time time.Time
 }
@@ -34,39 +75,146 @@ func (r *responseContext) getRspStatus() int16 {
 	return r.status
 }
 
-func (res *responseContext) wrapResponse() []byte {
+// wrapResponse serialize the response, the body of the HEAD request is
+// suppressed.
+func (res *responseContext) wrapResponse(head bool) []byte {
 	defer func() {
 		res.rspBody = []byte{}
+		res.rendered = false
 		res.body.Reset()
 	}()
-	res.wrap()
+	res.wrap(head)
 	return res.body.Bytes()
 }
 
-func (res *responseContext) wrap() {
-	firstLine := fmt.Sprintf("HTTP/1.1 %d\r\n", res.status)
-	res.body.Write(internal.StringToBytes(firstLine))
-	for k, v := range res.rspHeaders {
-		res.body.Write(internal.StringToBytes(k + ": " + v.(string) + "\r\n"))
+// bodyAllowed report whether the response of the status carries a body,
+// the 1xx, 204 and 304 don't.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+func (res *responseContext) wrap(head bool) {
+	// the HEAD response keeps the length of the entity set by the
+	// handler.
+	length := strconv.Itoa(len(res.rspBody))
+	if cl := res.rspHeaders.Get("Content-Length"); head && len(res.rspBody) == 0 && cl != "" {
+		length = cl
 	}
+	status := res.writeHead()
+	if !bodyAllowed(status) {
+		res.body.WriteString("\r\n")
+		return
+	}
+	// the empty body is framed too, so the persistent connection
+	// can read the next response.
+	res.body.WriteString("Content-Length: " + length + "\r\n\r\n")
+	if !head {
+		res.body.Write(res.rspBody)
+	}
+}
 
-	res.body.Write(internal.StringToBytes("Server: RX\r\n"))
+// writeHead write the status line and the headers except the framing
+// ones, which are written by the caller with the blank line. return the
+// status written.
+func (res *responseContext) writeHead() int {
+	status := int(res.status)
+	if status == 0 {
+		status = 200
+	}
+	reason := http.StatusText(status)
+	if reason == "" {
+		reason = "status code " + strconv.Itoa(status)
+	}
+	res.body.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + reason + "\r\n")
+
+	res.rspHeaders.Del("Content-Length")
+	res.rspHeaders.Del("Transfer-Encoding")
+	for k, vs := range res.rspHeaders {
+		if !validHeaderName(k) {
+			logger.Log.Error("invalid header name %q", k)
+			continue
+		}
+		for _, v := range vs {
+			res.body.WriteString(k + ": " + headerNewline.Replace(v) + "\r\n")
+		}
+	}
+	if _, ok := res.rspHeaders["Server"]; !ok {
+		res.body.WriteString("Server: RX\r\n")
+	}
+	if _, ok := res.rspHeaders["Date"]; !ok {
+		res.body.WriteString("Date: " + httpDate() + "\r\n")
+	}
+	return status
+}
 
-	if len(res.rspBody) > 0 {
-		res.body.Write(internal.StringToBytes(fmt.Sprintf("Content-Length: %d", len(res.rspBody)) + "\r\n"))
-		res.body.Write(internal.StringToBytes("\r\n"))
-		res.body.Write(res.rspBody)
+// dateValue is the Date header of the second.
+type dateValue struct {
+	unix  int64
+	value string
+}
+
+var dateCache atomic.Value
+
+// httpDate return the Date header value, it's formatted once a second.
+func httpDate() string {
+	now := time.Now()
+	if d, ok := dateCache.Load().(*dateValue); ok && d.unix == now.Unix() {
+		return d.value
 	}
+	d := &dateValue{unix: now.Unix(), value: now.UTC().Format(http.TimeFormat)}
+	dateCache.Store(d)
+	return d.value
 }
 
-func (rsp *responseContext) JSON(status int16, response interface{}) {
+func (rsp *responseContext) Status(status int16) {
 	rsp.status = status
-	rsp.rspHeaders["Content-Type"] = internal.MIMEJSON
-	bits, err := json.Marshal(response)
-	if err != nil {
-		logger.Log.Error("marshal err: %v", err)
+}
+
+// headerNewline keeps the header values from splitting the response.
+var headerNewline = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// validHeaderName report whether the name is a token of the RFC 7230,
+// the other names would split or corrupt the response.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 0x7f || c <= ' ' || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (rsp *responseContext) SetHeader(key, value string) {
+	rsp.rspHeaders.Set(key, value)
+}
+
+func (rsp *responseContext) AddHeader(key, value string) {
+	rsp.rspHeaders.Add(key, value)
+}
+
+func (rsp *responseContext) DelHeader(key string) {
+	rsp.rspHeaders.Del(key)
+}
+
+func (rsp *responseContext) SetCookie(cookie *Cookie) {
+	c := cookie.Cookie
+	// the browsers reject the partitioned cookie without Secure.
+	if cookie.Partitioned {
+		c.Secure = true
+	}
+	v := c.String()
+	if v == "" {
+		logger.Log.Error("invalid cookie name %q", cookie.Name)
+		return
+	}
+	if cookie.Partitioned && !strings.HasSuffix(v, "; Partitioned") {
+		v += "; Partitioned"
 	}
-	rsp.rspBody = append(rsp.rspBody, bits...)
+	rsp.rspHeaders.Add("Set-Cookie", v)
 }
 
 func (rsp *responseContext) stopTime() time.Time {
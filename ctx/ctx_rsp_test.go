@@ -0,0 +1,160 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	Register("get", "/rsp/header", func(c ReqCxtI) {
+		session, err := c.Cookie("session")
+		if err != nil {
+			c.Abort(401, err.Error())
+			return
+		}
+		c.SetHeader("X-Trace", c.GetHeader("X-Trace"))
+		c.AddHeader("X-Multi", "a")
+		c.AddHeader("X-Multi", "b")
+		c.SetHeader("X-Gone", "x")
+		c.DelHeader("X-Gone")
+		c.SetHeader("X-Inject", "v\r\nX-Evil: 1")
+		c.SetHeader("X-Key\r\nX-Evil-Key: 1\r\nX", "v")
+		c.SetCookie(&Cookie{Cookie: http.Cookie{Name: "session", Value: session, Path: "/", MaxAge: 60,
+			HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode}, Partitioned: true})
+		c.SetCookie(&Cookie{Cookie: http.Cookie{Name: "theme", Value: "dark"}})
+		c.SetCookie(&Cookie{Cookie: http.Cookie{Name: "embed", Value: "e1"}, Partitioned: true})
+		c.JSON(200, session)
+	})
+	Register("get", "/rsp/status/:code", func(c ReqCxtI) {
+		code, _ := strconv.Atoi(c.GetParam("code"))
+		c.String(int16(code), "body")
+	})
+	Register("head", "/rsp/status/:code", func(c ReqCxtI) {
+		code, _ := strconv.Atoi(c.GetParam("code"))
+		c.String(int16(code), "body")
+	})
+	Register("head", "/rsp/entity", func(c ReqCxtI) {
+		c.SetHeader("Content-Length", "1024")
+		c.Status(200)
+	})
+}
+
+func TestHeaderCookie(t *testing.T) {
+	addr := serve(t)
+	req, _ := http.NewRequest("GET", "http://"+addr+"/rsp/header", nil)
+	req.Header.Set("X-Trace", "t1")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, rsp)
+	if rsp.StatusCode != 200 || body != `"s1"` {
+		t.Fatalf("status %d body %s", rsp.StatusCode, body)
+	}
+	if rsp.Header.Get("X-Trace") != "t1" || strings.Join(rsp.Header.Values("X-Multi"), ",") != "a,b" {
+		t.Fatalf("headers %v", rsp.Header)
+	}
+	if _, ok := rsp.Header["X-Gone"]; ok {
+		t.Fatal("deleted header sent")
+	}
+	if _, ok := rsp.Header["X-Evil-Key"]; ok {
+		t.Fatal("header key injected")
+	}
+	if _, ok := rsp.Header["X-Evil"]; ok {
+		t.Fatal("header injected")
+	}
+	cookies := rsp.Header.Values("Set-Cookie")
+	if len(cookies) != 3 {
+		t.Fatalf("cookies %v", cookies)
+	}
+	for _, attr := range []string{"session=s1", "Path=/", "Max-Age=60", "HttpOnly", "Secure", "SameSite=None", "Partitioned"} {
+		if !strings.Contains(cookies[0], attr) {
+			t.Fatalf("cookie %s lacks %s", cookies[0], attr)
+		}
+	}
+	// the partitioned cookie is Secure.
+	if !strings.Contains(cookies[2], "Secure") || !strings.Contains(cookies[2], "Partitioned") {
+		t.Fatalf("cookie %s", cookies[2])
+	}
+
+	rsp = roundTrip(t, addr, "GET /rsp/header HTTP/1.1\r\nHost: x\r\n\r\n")
+	if readBody(t, rsp); rsp.StatusCode != 401 {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+}
+
+func TestResponseConformance(t *testing.T) {
+	addr := serve(t)
+	// the persistent connection hangs on the misframed response.
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{MaxConnsPerHost: 1}}
+	for _, tc := range []struct {
+		method string
+		code   int
+		body   string
+		length int64
+	}{
+		{"GET", 200, "body", 4},
+		{"GET", 204, "", 0},
+		{"GET", 304, "", 0},
+		{"GET", 404, "body", 4},
+		{"GET", 599, "body", 4},
+		{"HEAD", 200, "", 4},
+		{"HEAD", 204, "", -1},
+		{"GET", 201, "body", 4},
+	} {
+		req, _ := http.NewRequest(tc.method, "http://"+addr+"/rsp/status/"+strconv.Itoa(tc.code), nil)
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %d: %v", tc.method, tc.code, err)
+		}
+		body := readBody(t, rsp)
+		if rsp.StatusCode != tc.code || body != tc.body || rsp.ContentLength != tc.length {
+			t.Fatalf("%s %d: status %d body %q length %d", tc.method, tc.code, rsp.StatusCode, body, rsp.ContentLength)
+		}
+		if _, err := http.ParseTime(rsp.Header.Get("Date")); err != nil {
+			t.Fatalf("%s %d: Date %q", tc.method, tc.code, rsp.Header.Get("Date"))
+		}
+	}
+
+	req, _ := http.NewRequest("HEAD", "http://"+addr+"/rsp/entity", nil)
+	rsp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readBody(t, rsp); rsp.ContentLength != 1024 {
+		t.Fatalf("HEAD entity length %d", rsp.ContentLength)
+	}
+
+	// the status line carries the reason phrase.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for code, want := range map[int]string{204: "HTTP/1.1 204 No Content", 599: "HTTP/1.1 599 status code 599"} {
+		_, _ = c.Write([]byte("GET /rsp/status/" + strconv.Itoa(code) + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+		line, err := br.Peek(len(want) + 2)
+		if err != nil || string(line) != want+"\r\n" {
+			t.Fatalf("status line %q %v", line, err)
+		}
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, rsp)
+		if _, ok := rsp.Header["Content-Length"]; ok == (code == 204) {
+			t.Fatalf("%d Content-Length %v", code, rsp.Header)
+		}
+	}
+}
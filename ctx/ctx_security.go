@@ -0,0 +1,237 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/huaxr/rx/internal"
+)
+
+// SecurityStrategy is the request aware security check, a non nil error
+// rejects the request. return a *SecurityError to choose the status and
+// the reason responded, other errors are rejected with 403.
+type SecurityStrategy interface {
+	Check(c ReqCxtI) error
+}
+
+// SecurityError is the rejection of a SecurityStrategy.
+type SecurityError struct {
+	Status int16
+	Reason string
+}
+
+func (e *SecurityError) Error() string {
+	return e.Reason
+}
+
+func securityDeny(status int16, format string, val ...interface{}) *SecurityError {
+	return &SecurityError{Status: status, Reason: fmt.Sprintf(format, val...)}
+}
+
+// SecurityChain checks the strategies in order, the first rejection wins.
+type SecurityChain []SecurityStrategy
+
+func (sc SecurityChain) Check(c ReqCxtI) error {
+	for _, s := range sc {
+		if err := s.Check(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trustedProxies the proxies whose forwarding headers are honoured by
+// ClientIP and the IPFilter without its own trusted proxies.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies set the cidrs of the trusted proxies, the
+// X-Forwarded-For, X-Real-IP and Forwarded headers from other peers
+// are ignored.
+func SetTrustedProxies(cidrs []string) error {
+	nets, err := internal.ParseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// ClientIP return the ip of the client, the forwarding headers are
+// honoured when the peer is a trusted proxy.
+func (rc *RequestContext) ClientIP() string {
+	if rc.request == nil {
+		if rc.conn == nil || rc.conn.RemoteAddr() == nil {
+			return ""
+		}
+		return internal.RemoteIP(rc.conn.RemoteAddr().String()).String()
+	}
+	ip := internal.ClientIP(internal.RemoteIP(rc.request.RemoteAddr), rc.request.Header, trustedProxies)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// IPFilter checks the client ip against the allow and deny lists, the
+// forwarding headers are honoured when the peer is a trusted proxy.
+type IPFilter struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	trusted []*net.IPNet
+}
+
+// NewIPFilter return the IPFilter of the cidr lists. an empty allow list
+// allows every ip which is not denied, an empty trustedProxies takes
+// the proxies of SetTrustedProxies.
+func NewIPFilter(allow, deny, trustedProxies []string) (*IPFilter, error) {
+	var err error
+	f := new(IPFilter)
+	if f.allow, err = internal.ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = internal.ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	if f.trusted, err = internal.ParseCIDRs(trustedProxies); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *IPFilter) Check(c ReqCxtI) error {
+	req := c.Request()
+	trusted := f.trusted
+	if len(trusted) == 0 {
+		trusted = trustedProxies
+	}
+	ip := internal.ClientIP(internal.RemoteIP(req.RemoteAddr), req.Header, trusted)
+	if ip == nil {
+		return securityDeny(403, "unknown client ip")
+	}
+	if internal.ContainsIP(f.deny, ip) {
+		return securityDeny(403, "ip %s denied", ip)
+	}
+	if len(f.allow) > 0 && !internal.ContainsIP(f.allow, ip) {
+		return securityDeny(403, "ip %s not allowed", ip)
+	}
+	return nil
+}
+
+// HeaderRule checks the request headers and user agent.
+type HeaderRule struct {
+	// Required headers must present, and equal the value when it is not empty.
+	Required map[string]string
+	// Forbidden headers must not present.
+	Forbidden []string
+	// AllowUserAgents the user agent must contain one of them when it is set.
+	AllowUserAgents []string
+	// DenyUserAgents the user agent must not contain any of them.
+	DenyUserAgents []string
+}
+
+func (h *HeaderRule) Check(c ReqCxtI) error {
+	header := c.Request().Header
+	for k, v := range h.Required {
+		got, ok := header[http.CanonicalHeaderKey(k)]
+		if !ok {
+			return securityDeny(400, "header %s required", k)
+		}
+		if v != "" && (len(got) == 0 || got[0] != v) {
+			return securityDeny(403, "header %s mismatch", k)
+		}
+	}
+	for _, k := range h.Forbidden {
+		if _, ok := header[http.CanonicalHeaderKey(k)]; ok {
+			return securityDeny(403, "header %s forbidden", k)
+		}
+	}
+	ua := strings.ToLower(header.Get("User-Agent"))
+	for _, deny := range h.DenyUserAgents {
+		if strings.Contains(ua, strings.ToLower(deny)) {
+			return securityDeny(403, "user agent %q denied", header.Get("User-Agent"))
+		}
+	}
+	if len(h.AllowUserAgents) == 0 {
+		return nil
+	}
+	for _, allow := range h.AllowUserAgents {
+		if strings.Contains(ua, strings.ToLower(allow)) {
+			return nil
+		}
+	}
+	return securityDeny(403, "user agent %q not allowed", header.Get("User-Agent"))
+}
+
+// MethodAllowlist rejects the methods not listed with 405.
+type MethodAllowlist []string
+
+func (m MethodAllowlist) Check(c ReqCxtI) error {
+	method := c.Request().Method
+	for _, allow := range m {
+		if strings.EqualFold(allow, method) {
+			return nil
+		}
+	}
+	return securityDeny(405, "method %s not allowed", method)
+}
+
+// SizeLimit limits the url, header and body sizes, 0 means no limit.
+type SizeLimit struct {
+	MaxURL    int
+	MaxHeader int
+	MaxBody   int64
+}
+
+func (s *SizeLimit) Check(c ReqCxtI) error {
+	req := c.Request()
+	if s.MaxURL > 0 && len(req.RequestURI) > s.MaxURL {
+		return securityDeny(414, "url length %d exceeds %d", len(req.RequestURI), s.MaxURL)
+	}
+	if s.MaxHeader > 0 {
+		size := 0
+		for k, vs := range req.Header {
+			for _, v := range vs {
+				size += len(k) + len(v) + 4
+			}
+		}
+		if size > s.MaxHeader {
+			return securityDeny(431, "header size %d exceeds %d", size, s.MaxHeader)
+		}
+	}
+	if s.MaxBody > 0 {
+		if req.ContentLength > s.MaxBody {
+			return securityDeny(413, "body size %d exceeds %d", req.ContentLength, s.MaxBody)
+		}
+		// the length of a chunked body is unknown until it is read.
+		req.Body = &limitedBody{ReadCloser: req.Body, remain: s.MaxBody}
+	}
+	return nil
+}
+
+// limitedBody fails the read once the body exceeds the limit.
+type limitedBody struct {
+	io.ReadCloser
+	remain int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remain < 0 {
+		return 0, securityDeny(413, "body too large")
+	}
+	if int64(len(p)) > l.remain+1 {
+		p = p[:l.remain+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remain -= int64(n)
+	if l.remain < 0 {
+		return n - 1, securityDeny(413, "body too large")
+	}
+	return n, err
+}
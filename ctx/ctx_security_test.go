@@ -0,0 +1,201 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sharedStrategy is registered by every request of the route, as the
+// handlers usually do with a package level value.
+var sharedStrategy = &StrategyContext{Security: SecurityChain{
+	&HeaderRule{Forbidden: []string{"X-Attack"}},
+	MethodAllowlist{"GET"},
+}}
+
+func init() {
+	Register("get", "/security/shared", func(c ReqCxtI) {
+		c.RegisterStrategy(sharedStrategy)
+	}, func(c ReqCxtI) {
+		c.String(200, "ok")
+	})
+	Register("post", "/security/body", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Security: &SizeLimit{MaxBody: 8}})
+	}, func(c ReqCxtI) {
+		b, err := ioutil.ReadAll(c.Body())
+		if se, ok := err.(*SecurityError); ok {
+			c.Abort(se.Status, se.Reason)
+			return
+		}
+		c.String(200, "%s", b)
+	})
+}
+
+// securityRequest return the request context of the peer.
+func securityRequest(method, target, remote string, header map[string]string) *RequestContext {
+	rc := &RequestContext{}
+	rc.request, _ = http.NewRequest(method, "http://rx"+target, nil)
+	rc.request.RequestURI = target
+	rc.request.RemoteAddr = remote
+	for k, v := range header {
+		rc.request.Header.Set(k, v)
+	}
+	return rc
+}
+
+func securityStatus(err error) int16 {
+	if err == nil {
+		return 0
+	}
+	if se, ok := err.(*SecurityError); ok {
+		return se.Status
+	}
+	return -1
+}
+
+func TestSecuritySharedStrategy(t *testing.T) {
+	addr := serve(t)
+	for i, tc := range []struct {
+		attack bool
+		status int
+		body   string
+	}{
+		{false, 200, "ok"},
+		{true, 403, "header X-Attack forbidden"},
+		{false, 200, "ok"},
+		{true, 403, "header X-Attack forbidden"},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/security/shared", nil)
+		if tc.attack {
+			req.Header.Set("X-Attack", "1")
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || body != tc.body {
+			t.Fatalf("request %d: %d %q", i, rsp.StatusCode, body)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.66/32"}, []string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewIPFilter([]string{"10.0.0.0/33"}, nil, nil); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+	for _, tc := range []struct {
+		remote, xff string
+		status      int16
+	}{
+		{"10.1.2.3:80", "", 0},
+		{"[2001:db8::1]:80", "", 0},
+		{"10.0.0.66:80", "", 403},
+		{"203.0.113.1:80", "", 403},
+		// the forged header of an untrusted peer is ignored.
+		{"203.0.113.1:80", "10.1.2.3", 403},
+		{"10.0.0.66:80", "10.1.2.3", 403},
+		// the trusted proxy forwards the client ip.
+		{"192.0.2.1:80", "10.1.2.3", 0},
+		{"192.0.2.1:80", "10.0.0.66", 403},
+		{"192.0.2.1:80", "203.0.113.1, 10.1.2.3", 0},
+		{"192.0.2.1:80", "10.1.2.3, 203.0.113.1", 403},
+		{"garbage", "", 403},
+	} {
+		rc := securityRequest("GET", "/", tc.remote, map[string]string{"X-Forwarded-For": tc.xff})
+		if got := securityStatus(filter.Check(rc)); got != tc.status {
+			t.Fatalf("%s %q: %d, want %d", tc.remote, tc.xff, got, tc.status)
+		}
+	}
+
+	// the filter without its own proxies trusts the SetTrustedProxies.
+	filter, _ = NewIPFilter([]string{"10.0.0.0/8"}, nil, nil)
+	rc := securityRequest("GET", "/", "192.0.2.1:80", map[string]string{"X-Forwarded-For": "10.1.2.3"})
+	if securityStatus(filter.Check(rc)) != 403 {
+		t.Fatal("untrusted proxy forwarded")
+	}
+	if err := SetTrustedProxies([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetTrustedProxies(nil) }()
+	if err := filter.Check(rc); err != nil {
+		t.Fatalf("trusted proxy: %v", err)
+	}
+	if ip := rc.ClientIP(); ip != "10.1.2.3" {
+		t.Fatalf("client ip %s", ip)
+	}
+	if err := SetTrustedProxies([]string{"garbage"}); err == nil {
+		t.Fatal("invalid proxy accepted")
+	}
+}
+
+func TestSecurityRules(t *testing.T) {
+	long := strings.Repeat("x", 64)
+	for i, tc := range []struct {
+		strategy SecurityStrategy
+		method   string
+		target   string
+		header   map[string]string
+		status   int16
+	}{
+		{MethodAllowlist{"get", "POST"}, "GET", "/", nil, 0},
+		{MethodAllowlist{"get", "POST"}, "POST", "/", nil, 0},
+		{MethodAllowlist{"get", "POST"}, "DELETE", "/", nil, 405},
+		{MethodAllowlist{}, "GET", "/", nil, 405},
+		{&SizeLimit{MaxURL: 32}, "GET", "/short", nil, 0},
+		{&SizeLimit{MaxURL: 32}, "GET", "/?q=" + long, nil, 414},
+		{&SizeLimit{MaxHeader: 64}, "GET", "/", map[string]string{"X-Small": "1"}, 0},
+		{&SizeLimit{MaxHeader: 64}, "GET", "/", map[string]string{"X-Large": long}, 431},
+		{&HeaderRule{Required: map[string]string{"X-Token": "t1"}}, "GET", "/", map[string]string{"X-Token": "t1"}, 0},
+		{&HeaderRule{Required: map[string]string{"X-Token": "t1"}}, "GET", "/", nil, 400},
+		{&HeaderRule{Required: map[string]string{"X-Token": "t1"}}, "GET", "/", map[string]string{"X-Token": "t2"}, 403},
+		{&HeaderRule{DenyUserAgents: []string{"curl"}}, "GET", "/", map[string]string{"User-Agent": "Curl/7.0"}, 403},
+		{&HeaderRule{AllowUserAgents: []string{"rx-client"}}, "GET", "/", map[string]string{"User-Agent": "rx-client/1"}, 0},
+		{&HeaderRule{AllowUserAgents: []string{"rx-client"}}, "GET", "/", map[string]string{"User-Agent": "other"}, 403},
+		// the first rejection of the chain wins.
+		{SecurityChain{MethodAllowlist{"GET"}, &SizeLimit{MaxURL: 1}}, "POST", "/long", nil, 405},
+		{SecurityChain{MethodAllowlist{"GET"}, &SizeLimit{MaxURL: 1}}, "GET", "/long", nil, 414},
+	} {
+		rc := securityRequest(tc.method, tc.target, "10.0.0.1:80", tc.header)
+		if got := securityStatus(tc.strategy.Check(rc)); got != tc.status {
+			t.Fatalf("case %d: %d, want %d", i, got, tc.status)
+		}
+	}
+}
+
+func TestSizeLimitBody(t *testing.T) {
+	rc := securityRequest("POST", "/", "10.0.0.1:80", nil)
+	rc.request.ContentLength = 9
+	if securityStatus((&SizeLimit{MaxBody: 8}).Check(rc)) != 413 {
+		t.Fatal("declared length over the limit admitted")
+	}
+
+	addr := serve(t)
+	for _, tc := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{"12345678", 200, "12345678"},
+		{"123456789", 413, "body too large"},
+	} {
+		// the chunked body declares no length, it's limited while read.
+		req, _ := http.NewRequest("POST", "http://"+addr+"/security/body", ioutil.NopCloser(strings.NewReader(tc.body)))
+		req.ContentLength = -1
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, rsp); rsp.StatusCode != tc.status || body != tc.want {
+			t.Fatalf("%q: %d %q", tc.body, rsp.StatusCode, body)
+		}
+	}
+}
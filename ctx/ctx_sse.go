@@ -0,0 +1,226 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a server-sent event, the fields left empty are not sent.
+type Event struct {
+	// Event the type of the event, "message" by default on the client.
+	Event string
+	// Data the string or []byte sent as it is, the others in JSON. the
+	// multiple lines are sent as the data lines.
+	Data interface{}
+	// ID the client sends back in the Last-Event-ID once reconnected.
+	ID string
+	// Retry the reconnection time of the client.
+	Retry time.Duration
+}
+
+// ErrStreamClosed is returned by the Send once the client is gone or the
+// stream is closed.
+var ErrStreamClosed = errors.New("event stream closed")
+
+// ErrStreamPending is returned by the Send once the queue is full before
+// the stream starts, the events are written after the handlers return,
+// so the handler sending more must send them from a goroutine.
+var ErrStreamPending = errors.New("event stream not started, the queue is full")
+
+// sseQueue the events queued before the stream is written.
+const sseQueue = 16
+
+// EventStream queues the events of the SSE response, the producer sends
+// them from any goroutine, the handler returns without waiting, e.g.
+//
+//	es := c.SSE()
+//	go func() {
+//		for {
+//			select {
+//			case <-es.Done():
+//				return
+//			case t := <-ticker.C:
+//				es.Send(ctx.Event{Event: "tick", Data: t})
+//			}
+//		}
+//	}()
+type EventStream struct {
+	lastID string
+	events chan []byte
+	// started is closed once the stream is written.
+	started   chan struct{}
+	startOnce sync.Once
+	// closing is closed by the Close, done once the stream ends.
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	doneOnce  sync.Once
+}
+
+// SSE respond with the event stream, the events sent are written once the
+// handlers return, a comment is sent every SSEHeartbeat to keep the
+// connection and find out the gone client.
+func (rc *RequestContext) SSE() *EventStream {
+	es := &EventStream{
+		lastID:  rc.request.Header.Get("Last-Event-ID"),
+		events:  make(chan []byte, sseQueue),
+		started: make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	rc.status = http.StatusOK
+	rc.rspHeaders.Set("Content-Type", "text/event-stream; charset=utf-8")
+	rc.rspHeaders.Set("Cache-Control", "no-cache")
+	// the proxies must not buffer the events.
+	rc.rspHeaders.Set("X-Accel-Buffering", "no")
+	heartbeat := getConfig().SSEHeartbeat
+	var timer *time.Timer
+	rc.Stream(func(w io.Writer) bool {
+		if timer == nil {
+			timer = time.NewTimer(heartbeat)
+			es.startOnce.Do(func() { close(es.started) })
+		}
+		return es.step(w, timer, heartbeat)
+	})
+	rc.streamEnd = func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		es.end()
+	}
+	return es
+}
+
+// LastEventID return the Last-Event-ID of the reconnected client, the
+// producer resumes after it.
+func (es *EventStream) LastEventID() string {
+	return es.lastID
+}
+
+// Send queue the event, it blocks while the queue is full. ErrStreamPending
+// is returned instead before the stream starts, ErrStreamClosed once the
+// stream ends.
+func (es *EventStream) Send(e Event) error {
+	b, err := e.encode()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-es.done:
+		return ErrStreamClosed
+	case <-es.closing:
+		return ErrStreamClosed
+	default:
+	}
+	select {
+	case es.events <- b:
+		return nil
+	case <-es.started:
+	default:
+		// the handler sending would wait for itself to return.
+		return ErrStreamPending
+	}
+	select {
+	case es.events <- b:
+		return nil
+	case <-es.done:
+		return ErrStreamClosed
+	case <-es.closing:
+		return ErrStreamClosed
+	}
+}
+
+// Close end the stream after the events queued.
+func (es *EventStream) Close() {
+	es.closeOnce.Do(func() { close(es.closing) })
+}
+
+// Done is closed once the stream ends, the client is gone or the Close
+// is called, the producer stops then.
+func (es *EventStream) Done() <-chan struct{} {
+	return es.done
+}
+
+func (es *EventStream) end() {
+	es.doneOnce.Do(func() { close(es.done) })
+}
+
+// step write the next event or the heartbeat, false once the stream ends.
+func (es *EventStream) step(w io.Writer, timer *time.Timer, heartbeat time.Duration) bool {
+	var b []byte
+	select {
+	case b = <-es.events:
+	case <-timer.C:
+		b = []byte(": keep-alive\n\n")
+	case <-es.closing:
+		// the events queued before the Close are sent.
+		select {
+		case b = <-es.events:
+		default:
+			return false
+		}
+	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(heartbeat)
+	if _, err := w.Write(b); err != nil {
+		return false
+	}
+	return w.(Flusher).Flush() == nil
+}
+
+// encode the event in the text/event-stream format.
+func (e *Event) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if e.ID != "" {
+		buf.WriteString("id: " + sseLine(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		buf.WriteString("event: " + sseLine(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		buf.WriteString("retry: " + strconv.FormatInt(int64(e.Retry/time.Millisecond), 10) + "\n")
+	}
+	var data string
+	switch d := e.Data.(type) {
+	case nil:
+	case string:
+		data = d
+	case []byte:
+		data = string(d)
+	default:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	if e.Data != nil {
+		data = strings.Replace(strings.Replace(data, "\r\n", "\n", -1), "\r", "\n", -1)
+		for _, line := range strings.Split(data, "\n") {
+			buf.WriteString("data: " + line + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// sseLine strip the line breaks ending the field.
+func sseLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
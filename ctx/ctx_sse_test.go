@@ -0,0 +1,223 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleStreams passes the idle event streams to the test.
+var idleStreams = make(chan *EventStream, 1)
+
+// openStreams passes the streams kept open to the test.
+var openStreams = make(chan *EventStream, 8)
+
+// burstErr passes the error of the event over the queue to the test.
+var burstErr = make(chan error, 1)
+
+func init() {
+	Register("get", "/sse/ticks", func(c ReqCxtI) {
+		es := c.SSE()
+		go func() {
+			defer es.Close()
+			_ = es.Send(Event{Event: "resume", Data: es.LastEventID(), Retry: 3 * time.Second})
+			for _, tick := range []string{"1", "2\n3"} {
+				_ = es.Send(Event{ID: tick[:1], Data: tick})
+			}
+			_ = es.Send(Event{Event: "end", Data: map[string]int{"n": 2}})
+		}()
+	})
+	Register("get", "/sse/burst", func(c ReqCxtI) {
+		es := c.SSE()
+		defer es.Close()
+		for i := 0; i < sseQueue; i++ {
+			_ = es.Send(Event{Data: i})
+		}
+		// the handler is not blocked by the queue it drains once returned.
+		burstErr <- es.Send(Event{Data: "over"})
+	})
+	Register("get", "/sse/idle", func(c ReqCxtI) {
+		idleStreams <- c.SSE()
+	})
+	Register("get", "/sse/open", func(c ReqCxtI) {
+		es := c.SSE()
+		_ = es.Send(Event{Data: "open"})
+		openStreams <- es
+	})
+	Register("head", "/sse/idle", func(c ReqCxtI) {
+		idleStreams <- c.SSE()
+	})
+}
+
+const ticks = "event: resume\nretry: 3000\ndata: 7\n\n" +
+	"id: 1\ndata: 1\n\n" +
+	"id: 2\ndata: 2\ndata: 3\n\n" +
+	"event: end\ndata: {\"n\":2}\n\n"
+
+func TestEventEncode(t *testing.T) {
+	for _, tc := range []struct {
+		e    Event
+		want string
+	}{
+		{Event{}, "\n"},
+		{Event{Data: ""}, "data: \n\n"},
+		{Event{Event: "a\nb", ID: "1\r", Data: []byte("x\r\ny\rz")}, "id: 1\nevent: ab\ndata: x\ndata: y\ndata: z\n\n"},
+		{Event{Data: []int{1}}, "data: [1]\n\n"},
+	} {
+		b, err := tc.e.encode()
+		if err != nil || string(b) != tc.want {
+			t.Fatalf("%+v: %q %v", tc.e, b, err)
+		}
+	}
+	if _, err := (&Event{Data: func() {}}).encode(); err == nil {
+		t.Fatal("unsupported data encoded")
+	}
+}
+
+func TestSSE(t *testing.T) {
+	addr := serve(t)
+	req, _ := http.NewRequest("GET", "http://"+addr+"/sse/ticks", nil)
+	req.Header.Set("Last-Event-ID", "7")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := rsp.Header.Get("Content-Type"); ct != "text/event-stream; charset=utf-8" || rsp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("headers %v", rsp.Header)
+	}
+	if body := readBody(t, rsp); body != ticks {
+		t.Fatalf("events %q", body)
+	}
+
+	// the heartbeats keep the idle stream, the producer is told once the
+	// client is gone.
+	SetConfig(Config{SSEHeartbeat: 20 * time.Millisecond})
+	defer SetConfig(Config{})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Write([]byte("GET /sse/idle HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	es := <-idleStreams
+	br := bufio.NewReader(c)
+	if rsp, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(rsp.Body).ReadString('\n')
+	if err != nil || line != ": keep-alive\n" {
+		t.Fatalf("heartbeat %q %v", line, err)
+	}
+	_ = c.Close()
+	select {
+	case <-es.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("producer not told")
+	}
+	if err := es.Send(Event{Data: "late"}); err != ErrStreamClosed {
+		t.Fatalf("send after disconnect: %v", err)
+	}
+}
+
+func TestEPollSSE(t *testing.T) {
+	lc := &loopConn{closed: make(chan struct{})}
+	NewEPollConn(lc).Serve([]byte("GET /sse/ticks HTTP/1.1\r\nHost: rx\r\nLast-Event-ID: 7\r\nConnection: close\r\n\r\n"))
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	rsp, err := http.ReadResponse(bufio.NewReader(&lc.out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if body, _ := ioutil.ReadAll(rsp.Body); string(body) != ticks {
+		t.Fatalf("events %q", body)
+	}
+
+	// the abandoned stream stops the producer too.
+	lc = &loopConn{closed: make(chan struct{})}
+	NewEPollConn(lc).Serve([]byte("HEAD /sse/idle HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	es := <-idleStreams
+	select {
+	case <-es.Done():
+	case <-time.After(time.Second):
+		t.Fatal("producer not told")
+	}
+	<-lc.closed
+	if out := lc.out.String(); !strings.Contains(out, "text/event-stream") || !strings.HasSuffix(out, "\r\n\r\n") {
+		t.Fatalf("head %q", out)
+	}
+}
+
+func TestSSEBurst(t *testing.T) {
+	addr := serve(t)
+	rsp, err := http.Get("http://" + addr + "/sse/burst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-burstErr; err != ErrStreamPending {
+		t.Fatalf("send over the queue: %v", err)
+	}
+	if body := readBody(t, rsp); strings.Count(body, "data: ") != sseQueue || strings.Contains(body, "over") {
+		t.Fatalf("events %q", body)
+	}
+}
+
+func TestSSEWorkers(t *testing.T) {
+	// the heartbeats keep the streams busy on their goroutines.
+	SetConfig(Config{SSEHeartbeat: 10 * time.Millisecond})
+	defer SetConfig(Config{})
+	addr := servePool(t, 2)
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		return c, bufio.NewReader(c)
+	}
+	// the clients outnumber the workers.
+	const clients = 6
+	var bodies []*bufio.Reader
+	for i := 0; i < clients; i++ {
+		c, br := dial()
+		_, _ = c.Write([]byte("GET /sse/open HTTP/1.1\r\nHost: rx\r\n\r\n"))
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		defer (<-openStreams).Close()
+		body := bufio.NewReader(rsp.Body)
+		if line, err := body.ReadString('\n'); err != nil || line != "data: open\n" {
+			t.Fatalf("client %d: %q %v", i, line, err)
+		}
+		bodies = append(bodies, body)
+	}
+	c, br := dial()
+	_, _ = c.Write([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	if rsp, err := http.ReadResponse(br, nil); err != nil || rsp.StatusCode != 200 {
+		t.Fatalf("request beside the event streams: %v", err)
+	}
+	// the streams are still alive.
+	for i, body := range bodies {
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				t.Fatalf("client %d: %v", i, err)
+			}
+			if line == ": keep-alive\n" {
+				break
+			}
+		}
+	}
+}
@@ -13,15 +13,10 @@ type StrategyI interface {
 	SetTTL(t int32)
 }
 
-type signal struct {
-	timeout       bool
-	timeoutSignal <-chan time.Time
-
-	//demotion bool
-}
-
+// ControlStrategy decides whether the request goes on, is denied,
+// delayed or rerouted to another handler chain.
 type ControlStrategy interface {
-	Do() bool
+	Decide(c ReqCxtI) Decision
 }
 
 // strategy is under developing now, it functions will enhanced later
@@ -46,10 +41,24 @@ type StrategyContext struct {
 	Fusing ControlStrategy
 
 	// for security reason, attack recognition or any other optional
-	// functions can be made && check here.
-	Security ControlStrategy
+	// functions can be made && check here. the rejection is responded
+	// with the status and reason of the *SecurityError.
+	Security SecurityStrategy
+
+	// Strategies the customized strategies decide in order after
+	// the Fusing and Security.
+	Strategies StrategyChain
+
+	// Retry re-executes the handler chain of the idempotent requests
+	// which end with a retryable status or error.
+	Retry *RetryPolicy
+
+	// adaptive load shedding, reject the requests over the
+	// concurrency limit with 503.
+	Limiter *AdaptiveLimiter
 
-	signal
+	// Compress the responses the client accepts compressed.
+	Compress *CompressPolicy
 }
 
 // openDefaultStrategy open the default strategy here.
@@ -61,34 +70,27 @@ type StrategyContext struct {
 // default Timeout never expire.
 func openDefaultStrategy() *StrategyContext {
 	s := new(StrategyContext)
-	s.Timeout = 0xff * time.Hour
-	s.Ttl = -1
 	s.Async = false
-	s.timeout = false
-	s.timeoutSignal = make(<-chan time.Time)
 	return s
 }
 
-// wrap the StrategyContext with a default never reached value.
-func (s *StrategyContext) wrapDefault() {
+// maxTTL return the Ttl with a default never reached value, the
+// StrategyContext is shared by the requests, it's not written.
+func (s *StrategyContext) maxTTL() int32 {
 	if s.Ttl <= 0 {
-		s.Ttl = 0xff
-	}
-	if s.Timeout <= 0 {
-		s.Timeout = 0xff * time.Hour
-		s.timeout = false
-	} else {
-		// when set the strategy, init the timeout chan
-		s.timeoutSignal = time.After(s.Timeout)
-		s.timeout = true
+		return 0xff
 	}
+	return s.Ttl
 }
 
+// SetTimeOut set the Timeout of the strategy before it's registered,
+// the handlers set the timeout of the request by c.SetTimeOut.
 func (s *StrategyContext) SetTimeOut(t time.Duration) {
-	s.timeoutSignal = time.After(t)
+	s.Timeout = t
 }
 
-// SetTTL the stack is inc 1 to the t set
+// SetTTL the stack is inc 1 to the t set, the handlers set the Ttl of
+// the request by c.SetTTL.
 func (s *StrategyContext) SetTTL(t int32) {
 	if t < 0 {
 		return
@@ -96,15 +98,8 @@ func (s *StrategyContext) SetTTL(t int32) {
 	s.Ttl = t + 1
 }
 
-func (s *StrategyContext) decTTL() {
-	if s.Ttl == 0 {
-		return
-	}
-	s.Ttl -= 1
-}
-
 func (s *StrategyContext) handleTimeOut(rc *RequestContext) {
-	rc.setAbort(200, "this router timeout")
+	rc.sendTimeout()
 }
 
 func (s *StrategyContext) handleTTL(rc *RequestContext) {
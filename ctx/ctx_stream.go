@@ -0,0 +1,211 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/huaxr/rx/logger"
+)
+
+// Flusher is implemented by the writer of the Stream, Flush sends the
+// bytes written so far as a chunk.
+type Flusher interface {
+	Flush() error
+}
+
+// LoopDrainer is implemented by the LoopConn limiting the bytes queued by
+// the streams, Drain blocks until the bytes queued and unsent are at most
+// n. false is returned once the connection is closed or the deadline
+// passes.
+type LoopDrainer interface {
+	Drain(n int, deadline time.Time) bool
+}
+
+const (
+	// maxChunk the bytes buffered before the writer flushes by itself.
+	maxChunk = 32 << 10
+	// maxQueued the bytes of a stream queued on the LoopConn.
+	maxQueued = 256 << 10
+)
+
+// Stream send the response incrementally once the handlers return, step
+// is called until it returns false or the client is gone, the writes of
+// each step are flushed after it. the response is chunked for HTTP/1.1,
+// the HTTP/1.0 connection is closed at the end instead.
+func (rc *RequestContext) Stream(step func(w io.Writer) bool) {
+	rc.stream = step
+	if !rc.request.ProtoAtLeast(1, 1) {
+		rc.keepAlive = false
+	}
+}
+
+// endStream notify the end of the stream, the abandoned one included.
+func (rc *RequestContext) endStream() {
+	if rc.streamEnd != nil {
+		rc.streamEnd()
+		rc.streamEnd = nil
+	}
+}
+
+// streamWriter frames the writes of the stream into chunks, the writes
+// are compressed first when the response is.
+type streamWriter struct {
+	rc      *RequestContext
+	conn    io.Writer
+	chunked bool
+
+	buf bytes.Buffer
+	zw  *compressor
+	err error
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	var n int
+	if sw.zw != nil {
+		n, _ = sw.zw.Write(p)
+	} else {
+		n, _ = sw.buf.Write(p)
+	}
+	if sw.buf.Len() >= maxChunk {
+		return n, sw.send()
+	}
+	return n, nil
+}
+
+// Flush send the bytes written so far.
+func (sw *streamWriter) Flush() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.zw != nil {
+		if err := sw.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	return sw.send()
+}
+
+// send write the buffer as a chunk, it waits for the LoopConn to drain.
+func (sw *streamWriter) send() error {
+	if sw.buf.Len() == 0 {
+		return nil
+	}
+	var frame []byte
+	if sw.chunked {
+		frame = append(strconv.AppendInt(frame, int64(sw.buf.Len()), 16), "\r\n"...)
+		frame = append(append(frame, sw.buf.Bytes()...), "\r\n"...)
+	} else {
+		frame = append(frame, sw.buf.Bytes()...)
+	}
+	sw.buf.Reset()
+	sw.err = sw.rc.streamWrite(sw.conn, frame)
+	return sw.err
+}
+
+// close end the stream, the compression trailer is flushed with the last
+// chunk.
+func (sw *streamWriter) close() error {
+	if sw.zw != nil {
+		_ = sw.zw.Close()
+		sw.zw = nil
+	}
+	if err := sw.send(); err != nil || !sw.chunked {
+		return err
+	}
+	return sw.rc.streamWrite(sw.conn, []byte("0\r\n\r\n"))
+}
+
+var errStreamStalled = errors.New("stream write stalled")
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamWrite write the bytes within the WriteTimeout, the LoopConn
+// drains the queued bytes first.
+func (rc *RequestContext) streamWrite(w io.Writer, b []byte) error {
+	deadline := time.Now().Add(getConfig().WriteTimeout)
+	switch c := w.(type) {
+	case LoopDrainer:
+		if !c.Drain(maxQueued-len(b), deadline) {
+			return errStreamStalled
+		}
+	case writeDeadliner:
+		_ = c.SetWriteDeadline(deadline)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// sendStream write the head and run the steps of the stream after the
+// previous response on its own goroutine, done is closed once it's
+// written. neither the epoll loop nor the std dispatch worker waits for
+// it.
+func (rc *RequestContext) sendStream() {
+	w, prev, done := rc.conn, rc.prev, rc.done
+	run := func() {
+		if prev != nil {
+			<-prev
+		}
+		if err := rc.streamTo(w); err != nil {
+			logger.Log.Warning("stream %s %s: %v", rc.GetMethod(), rc.GetPath(), err)
+			rc.keepAlive = false
+		}
+		rc.endStream()
+		if c, ok := w.(writeDeadliner); ok {
+			_ = c.SetWriteDeadline(time.Time{})
+		}
+		rc.finish()
+		close(done)
+	}
+	if rc.streaming != nil {
+		close(rc.streaming)
+	}
+	go run()
+}
+
+// streamTo write the response of the stream to w.
+func (rc *RequestContext) streamTo(w io.Writer) error {
+	head := rc.request.Method == http.MethodHead
+	sw := &streamWriter{rc: rc, conn: w, chunked: rc.request.ProtoAtLeast(1, 1)}
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+	if coding := rc.compressCoding(-1); coding != "" {
+		sw.zw = newCompressor(coding, rc.Compress.level(), &sw.buf)
+	}
+	status := rc.writeHead()
+	if sw.chunked && bodyAllowed(status) {
+		rc.body.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	rc.body.WriteString("\r\n")
+	err := rc.streamWrite(w, rc.body.Bytes())
+	rc.body.Reset()
+	if err != nil || head || !bodyAllowed(status) {
+		if sw.zw != nil {
+			_ = sw.zw.Close()
+		}
+		return err
+	}
+	for sw.err == nil && rc.stream(sw) {
+		_ = sw.Flush()
+	}
+	if sw.err != nil {
+		if sw.zw != nil {
+			_ = sw.zw.Close()
+		}
+		return sw.err
+	}
+	return sw.close()
+}
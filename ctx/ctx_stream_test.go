@@ -0,0 +1,274 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	// streamGate lets the producer go on once the client read the chunk.
+	streamGate = make(chan struct{})
+	// endlessSteps counts the steps of the endless stream.
+	endlessSteps int32
+)
+
+func init() {
+	Register("get", "/stream/lines", func(c ReqCxtI) {
+		i := 0
+		c.SetHeader("Content-Type", MIMEPlain)
+		c.Stream(func(w io.Writer) bool {
+			fmt.Fprintf(w, "line %d\n", i)
+			i++
+			return i < 5
+		})
+	})
+	Register("get", "/stream/gated", func(c ReqCxtI) {
+		i := 0
+		c.Stream(func(w io.Writer) bool {
+			if i > 0 {
+				<-streamGate
+			}
+			fmt.Fprintf(w, "part %d;", i)
+			i++
+			return i < 2
+		})
+	})
+	Register("get", "/stream/endless", func(c ReqCxtI) {
+		chunk := strings.Repeat("x", 16<<10)
+		c.Stream(func(w io.Writer) bool {
+			_, _ = io.WriteString(w, chunk)
+			return atomic.AddInt32(&endlessSteps, 1) < 1<<16
+		})
+	})
+	Register("get", "/stream/compressed", func(c ReqCxtI) {
+		c.RegisterStrategy(&StrategyContext{Compress: &CompressPolicy{}})
+	}, func(c ReqCxtI) {
+		i := 0
+		c.Stream(func(w io.Writer) bool {
+			io.WriteString(w, compressText)
+			w.(Flusher).Flush()
+			i++
+			return i < 3
+		})
+	})
+}
+
+func TestStream(t *testing.T) {
+	addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	// the chunked response keeps the connection for the next request.
+	for i := 0; i < 2; i++ {
+		_, _ = c.Write([]byte("GET /stream/lines HTTP/1.1\r\nHost: rx\r\n\r\n"))
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp.TransferEncoding) != 1 || rsp.TransferEncoding[0] != "chunked" || rsp.ContentLength != -1 {
+			t.Fatalf("framing %v %d", rsp.TransferEncoding, rsp.ContentLength)
+		}
+		if body := readBody(t, rsp); body != "line 0\nline 1\nline 2\nline 3\nline 4\n" {
+			t.Fatalf("body %q", body)
+		}
+	}
+
+	// the first chunk is sent before the producer goes on.
+	_, _ = c.Write([]byte("GET /stream/gated HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	rsp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, len("part 0;"))
+	if _, err := io.ReadFull(rsp.Body, first); err != nil || string(first) != "part 0;" {
+		t.Fatalf("first chunk %q %v", first, err)
+	}
+	streamGate <- struct{}{}
+	if rest := readBody(t, rsp); rest != "part 1;" {
+		t.Fatalf("rest %q", rest)
+	}
+
+	// HTTP/1.0 is delimited by the close.
+	rsp = roundTrip(t, addr, "GET /stream/lines HTTP/1.0\r\n\r\n")
+	if body := readBody(t, rsp); len(rsp.TransferEncoding) != 0 || !rsp.Close || !strings.HasPrefix(body, "line 0\n") {
+		t.Fatalf("HTTP/1.0 %v %q", rsp.TransferEncoding, body)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/stream/compressed", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.Header.Get("Content-Encoding") != codingGzip || decode(t, codingGzip, rsp.Body) != strings.Repeat(compressText, 3) {
+		t.Fatalf("compressed stream %v", rsp.Header)
+	}
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	addr := serve(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Write([]byte("GET /stream/endless HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.CopyN(ioutil.Discard, rsp.Body, 64<<10)
+	_ = c.Close()
+	// the producer stops once the writes fail.
+	last := atomic.LoadInt32(&endlessSteps)
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		time.Sleep(200 * time.Millisecond)
+		steps := atomic.LoadInt32(&endlessSteps)
+		if steps == last {
+			return
+		}
+		last = steps
+	}
+	t.Fatalf("producer not stopped after %d steps", last)
+}
+
+// servePool serve the connections by the dispatch workers as the std
+// engine, the kept connections are dispatched back to them.
+func servePool(t *testing.T, workers int) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	queue := make(chan net.Conn, 64)
+	var dispatch func(net.Conn)
+	dispatch = func(c net.Conn) {
+		queue <- c
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for c := range queue {
+				ServeStd(c, "http", dispatch)
+			}
+		}()
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			queue <- c
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStreamWorkers(t *testing.T) {
+	addr := servePool(t, 2)
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		return c, bufio.NewReader(c)
+	}
+	// the streams outnumber the workers.
+	type stream struct {
+		c   net.Conn
+		br  *bufio.Reader
+		rsp *http.Response
+	}
+	var streams []stream
+	for i := 0; i < 3; i++ {
+		c, br := dial()
+		_, _ = c.Write([]byte("GET /stream/gated HTTP/1.1\r\nHost: rx\r\n\r\n"))
+		rsp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		first := make([]byte, len("part 0;"))
+		if _, err := io.ReadFull(rsp.Body, first); err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		streams = append(streams, stream{c, br, rsp})
+	}
+	c, br := dial()
+	_, _ = c.Write([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	if rsp, err := http.ReadResponse(br, nil); err != nil || rsp.StatusCode != 200 {
+		t.Fatalf("request beside the streams: %v", err)
+	}
+	// the connection is served on once the stream ends.
+	for i, s := range streams {
+		streamGate <- struct{}{}
+		if rest := readBody(t, s.rsp); rest != "part 1;" {
+			t.Fatalf("stream %d rest %q", i, rest)
+		}
+		_, _ = s.c.Write([]byte("GET /keepalive/empty HTTP/1.1\r\nHost: rx\r\n\r\n"))
+		if rsp, err := http.ReadResponse(s.br, nil); err != nil || rsp.StatusCode != 200 {
+			t.Fatalf("request after stream %d: %v", i, err)
+		}
+	}
+}
+
+// stalledConn never drains, as the client stopped reading.
+type stalledConn struct {
+	*loopConn
+	drains int32
+}
+
+func (s *stalledConn) Drain(n int, deadline time.Time) bool {
+	// the head is let through.
+	return atomic.AddInt32(&s.drains, 1) == 1
+}
+
+func TestEPollStream(t *testing.T) {
+	lc := &loopConn{closed: make(chan struct{})}
+	ec := NewEPollConn(lc)
+	ec.Serve([]byte("GET /stream/lines HTTP/1.1\r\nHost: rx\r\n\r\nGET /rsp/status/200 HTTP/1.1\r\nHost: rx\r\nConnection: close\r\n\r\n"))
+	select {
+	case <-lc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	br := bufio.NewReader(&lc.out)
+	rsp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, rsp); body != "line 0\nline 1\nline 2\nline 3\nline 4\n" {
+		t.Fatalf("body %q", body)
+	}
+	// the pipelined response follows the stream.
+	if rsp, err = http.ReadResponse(br, nil); err != nil || rsp.StatusCode != 200 {
+		t.Fatalf("next response %v", err)
+	}
+
+	sc := &stalledConn{loopConn: &loopConn{closed: make(chan struct{})}}
+	NewEPollConn(sc).Serve([]byte("GET /stream/lines HTTP/1.1\r\nHost: rx\r\n\r\n"))
+	select {
+	case <-sc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stalled connection not closed")
+	}
+	if out := sc.out.String(); !strings.HasSuffix(out, "\r\n\r\n") || strings.Contains(out, "line") {
+		t.Fatalf("stalled output %q", out)
+	}
+}
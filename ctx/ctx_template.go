@@ -0,0 +1,298 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/huaxr/rx/logger"
+)
+
+// TemplateConfig of the html templates rendered by the HTML. the page is
+// named by its path without the extension, e.g. "users/show", and parsed
+// with the shared layouts and partials, so the page can define the blocks
+// of the layout it calls:
+//
+//	{{define "content"}}...{{end}}{{template "layouts/base" .}}
+type TemplateConfig struct {
+	// Dir the directory of the templates.
+	Dir string
+	// FS the file system of the templates instead of the Dir, the embed.FS
+	// of go1.16 is served by http.FS(embedded).
+	FS http.FileSystem
+	// Ext the extension of the template files, default ".html".
+	Ext string
+	// Shared the directories of the layouts and partials parsed with each
+	// page, default "layouts" and "partials".
+	Shared []string
+	// Funcs the functions called by the templates.
+	Funcs template.FuncMap
+	// Reload parse the templates again once the files changed, for the
+	// development only.
+	Reload bool
+}
+
+// templateSet is the parsed pages, stamps the modification time of the
+// files to find out the changes.
+type templateSet struct {
+	// checked the unix nano the changes are last looked for.
+	checked int64
+	config  TemplateConfig
+	pages   map[string]*template.Template
+	stamps  map[string]time.Time
+}
+
+// reloadCheck throttles the walks of the template files in the Reload mode.
+const reloadCheck = time.Second
+
+var (
+	templates atomic.Value
+	// reloading serializes the reloads of the changed templates.
+	reloading sync.Mutex
+)
+
+var errNoTemplates = errors.New("templates not loaded")
+
+// LoadTemplates parse the templates rendered by the HTML, the templates
+// loaded before are replaced.
+func LoadTemplates(c TemplateConfig) error {
+	if c.FS == nil {
+		if c.Dir == "" {
+			return errors.New("templates without the Dir or FS")
+		}
+		c.FS = http.Dir(c.Dir)
+	}
+	if c.Ext == "" {
+		c.Ext = ".html"
+	}
+	if c.Shared == nil {
+		c.Shared = []string{"layouts", "partials"}
+	}
+	set, err := parseTemplates(c)
+	if err != nil {
+		return err
+	}
+	templates.Store(set)
+	return nil
+}
+
+// templateFile is a template file read.
+type templateFile struct {
+	name string
+	text string
+}
+
+// parseTemplates parse each page with the shared files.
+func parseTemplates(c TemplateConfig) (*templateSet, error) {
+	stamps, err := stampTemplates(c)
+	if err != nil {
+		return nil, err
+	}
+	var shared, pages []templateFile
+	for p := range stamps {
+		b, err := readTemplate(c.FS, p)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(p, "/"), c.Ext)
+		if isShared(c.Shared, name) {
+			shared = append(shared, templateFile{name, string(b)})
+		} else {
+			pages = append(pages, templateFile{name, string(b)})
+		}
+	}
+	set := &templateSet{
+		checked: time.Now().UnixNano(),
+		config:  c,
+		pages:   make(map[string]*template.Template, len(pages)),
+		stamps:  stamps,
+	}
+	for _, page := range pages {
+		t := template.New(page.name).Funcs(c.Funcs)
+		for _, f := range shared {
+			if _, err := t.New(f.name).Parse(f.text); err != nil {
+				return nil, err
+			}
+		}
+		// the page parsed last overrides the blocks of the layouts.
+		if _, err := t.Parse(page.text); err != nil {
+			return nil, err
+		}
+		set.pages[page.name] = t
+	}
+	return set, nil
+}
+
+func isShared(shared []string, name string) bool {
+	for _, dir := range shared {
+		if strings.HasPrefix(name, strings.Trim(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func readTemplate(fs http.FileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// stampTemplates return the modification time of the template files.
+func stampTemplates(c TemplateConfig) (map[string]time.Time, error) {
+	stamps := map[string]time.Time{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		f, err := c.FS.Open(dir)
+		if err != nil {
+			return err
+		}
+		infos, err := f.Readdir(-1)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			p := path.Join(dir, info.Name())
+			if info.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+			} else if strings.HasSuffix(p, c.Ext) {
+				stamps[p] = info.ModTime()
+			}
+		}
+		return nil
+	}
+	return stamps, walk("/")
+}
+
+// changed report whether the template files are changed since parsed,
+// they are looked for once a reloadCheck, the requests meanwhile see
+// them unchanged.
+func (set *templateSet) changed() bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&set.checked)
+	if now-last < int64(reloadCheck) || !atomic.CompareAndSwapInt64(&set.checked, last, now) {
+		return false
+	}
+	stamps, err := stampTemplates(set.config)
+	if err != nil || len(stamps) != len(set.stamps) {
+		return true
+	}
+	for p, t := range stamps {
+		if !t.Equal(set.stamps[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadedTemplates return the templates, the changed ones are parsed again
+// in the Reload mode.
+func loadedTemplates() (*templateSet, error) {
+	set, _ := templates.Load().(*templateSet)
+	if set == nil {
+		return nil, errNoTemplates
+	}
+	if !set.config.Reload || !set.changed() {
+		return set, nil
+	}
+	reloading.Lock()
+	defer reloading.Unlock()
+	if current := templates.Load().(*templateSet); current != set {
+		return current, nil
+	}
+	set, err := parseTemplates(set.config)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(set)
+	return set, nil
+}
+
+// executeTemplate render the page with the data.
+func executeTemplate(name string, data interface{}) ([]byte, error) {
+	set, err := loadedTemplates()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := set.pages[name]
+	if !ok {
+		return nil, errors.New("template " + name + " not found")
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HTML render the template loaded by the LoadTemplates, 500 is responded
+// once it fails.
+func (rsp *responseContext) HTML(status int16, name string, data interface{}) {
+	body, err := executeTemplate(name, data)
+	if err != nil {
+		logger.Log.Error("render template %s: %v", name, err)
+		rsp.render(500, contentPlain, []byte("render template failed"))
+		return
+	}
+	rsp.render(status, contentHTML, body)
+}
+
+// ErrorPage is the data of the error page templates.
+type ErrorPage struct {
+	Status  int16
+	Message string
+}
+
+var errorPages sync.Map
+
+// SetErrorPage render the Abort of the status with the template once
+// HTML is preferred, the data is the ErrorPage. the status without the
+// default handler is given one aborting with the status text. "" removes
+// the page. it's called before serving as the SetDefaultHandler, the
+// default handlers are not guarded.
+func SetErrorPage(status int16, name string) {
+	if name == "" {
+		errorPages.Delete(status)
+		return
+	}
+	errorPages.Store(status, name)
+	if _, ok := defaultHANDLERS[status]; !ok {
+		message := http.StatusText(int(status))
+		SetDefaultHandler(status, func(ctx ReqCxtI) {
+			ctx.Abort(status, message)
+		})
+	}
+}
+
+// renderErrorPage render the error page of the status, false once there's
+// none or it fails.
+func (rsp *responseContext) renderErrorPage(status int16, message string) bool {
+	name, ok := errorPages.Load(status)
+	if !ok {
+		return false
+	}
+	body, err := executeTemplate(name.(string), ErrorPage{Status: status, Message: message})
+	if err != nil {
+		logger.Log.Error("render error page %d: %v", status, err)
+		return false
+	}
+	rsp.render(status, contentHTML, body)
+	return true
+}
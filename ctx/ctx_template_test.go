@@ -0,0 +1,126 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	Register("get", "/tpl/page/:name", func(c ReqCxtI) {
+		c.HTML(200, strings.Replace(c.GetParam("name"), ".", "/", -1), map[string]string{"Name": "<rx>"})
+	})
+	Register("get", "/tpl/offer", func(c ReqCxtI) {
+		data := map[string]string{"Name": "<rx>"}
+		c.Negotiate(200, Offer{JSON: data, HTML: HTMLOffer{Name: "index", Data: data}})
+	})
+	Register("get", "/tpl/abort", func(c ReqCxtI) {
+		c.Abort(500, "db down")
+	})
+}
+
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	for name, text := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{
+		"layouts/base.html":  `<html>{{template "partials/nav" .}}{{block "content" .}}empty{{end}}</html>`,
+		"partials/nav.html":  `<nav>{{shout "rx"}}</nav>`,
+		"index.html":         `{{define "content"}}hi {{.Name}}{{end}}{{template "layouts/base" .}}`,
+		"users/show.html":    `{{template "layouts/base" .}}`,
+		"errors/404.html":    `<h1>{{.Status}} {{.Message}}</h1>`,
+		"errors/500.html":    `<h1>oops {{.Message}}</h1>`,
+		"notes.txt":          `{{not parsed`,
+		"layouts/empty.html": ``,
+	})
+	funcs := template.FuncMap{"shout": strings.ToUpper}
+	if err := LoadTemplates(TemplateConfig{Dir: dir, Funcs: funcs, Reload: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer templates.Store((*templateSet)(nil))
+	addr := serve(t)
+	get := func(path, accept string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		req.Header.Set("Accept", accept)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp.StatusCode, readBody(t, rsp)
+	}
+	for path, want := range map[string]string{
+		"/tpl/page/index":      "<html><nav>RX</nav>hi &lt;rx&gt;</html>",
+		"/tpl/page/users.show": "<html><nav>RX</nav>empty</html>",
+	} {
+		if status, body := get(path, ""); status != 200 || body != want {
+			t.Fatalf("%s: %d %q", path, status, body)
+		}
+	}
+	if status, body := get("/tpl/offer", "text/html"); status != 200 || body != "<html><nav>RX</nav>hi &lt;rx&gt;</html>" {
+		t.Fatalf("offer: %d %q", status, body)
+	}
+	if status, body := get("/tpl/page/missing", ""); status != 500 || body != "render template failed" {
+		t.Fatalf("missing: %d %q", status, body)
+	}
+
+	// the changed template is parsed again.
+	atomic.StoreInt64(&templates.Load().(*templateSet).checked, time.Now().UnixNano())
+	writeTemplates(t, dir, map[string]string{"index.html": `{{define "content"}}bye{{end}}{{template "layouts/base" .}}`})
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(filepath.Join(dir, "index.html"), later, later)
+	// the files are looked for once a reloadCheck.
+	if _, body := get("/tpl/page/index", ""); body != "<html><nav>RX</nav>hi &lt;rx&gt;</html>" {
+		t.Fatalf("checked within the reloadCheck %q", body)
+	}
+	atomic.StoreInt64(&templates.Load().(*templateSet).checked, 0)
+	if _, body := get("/tpl/page/index", ""); body != "<html><nav>RX</nav>bye</html>" {
+		t.Fatalf("reloaded %q", body)
+	}
+
+	// the error pages once HTML is preferred.
+	SetErrorPage(404, "errors/404")
+	SetErrorPage(500, "errors/500")
+	defer SetErrorPage(404, "")
+	defer SetErrorPage(500, "")
+	if status, body := get("/tpl/none", "text/html"); status != 404 || body != "<h1>404 Page not found</h1>" {
+		t.Fatalf("404 page: %d %q", status, body)
+	}
+	if status, body := get("/tpl/abort", ""); status != 500 || body != "<h1>oops db down</h1>" {
+		t.Fatalf("500 page: %d %q", status, body)
+	}
+	if status, body := get("/tpl/abort", "application/json"); status != 500 || body != `{"message":"db down"}` {
+		t.Fatalf("500 json: %d %q", status, body)
+	}
+
+	// the file system instead of the directory.
+	if err := LoadTemplates(TemplateConfig{FS: http.Dir(dir), Funcs: funcs}); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get("/tpl/page/index", ""); body != "<html><nav>RX</nav>bye</html>" {
+		t.Fatalf("fs %q", body)
+	}
+	writeTemplates(t, dir, map[string]string{"broken.html": `{{if}}`})
+	if err := LoadTemplates(TemplateConfig{Dir: dir, Funcs: funcs}); err == nil {
+		t.Fatal("broken template loaded")
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huaxr/rx/ctx/storage"
+	"github.com/huaxr/rx/logger"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// MIMEOffsetOctetStream is the content type of the PATCH chunks.
+	MIMEOffsetOctetStream = "application/offset+octet-stream"
+)
+
+// Upload is the state of a resumable upload.
+type Upload struct {
+	ID       string
+	Length   int64
+	Offset   int64
+	Metadata map[string]string
+	Expires  time.Time
+	// Chunks the offsets of the chunks stored.
+	Chunks []int64
+
+	busy bool
+	// mu is the lock of the Uploads guarding the state.
+	mu *sync.Mutex
+}
+
+// Uploads serves the tus style resumable uploads, the chunks are stored
+// to the Storage under "{id}/", the assembled file is "{id}/data":
+//
+//	POST   /            create the upload of the Upload-Length, 201 with the Location
+//	HEAD   /:id         query the Upload-Offset
+//	PATCH  /:id         append the chunk at the Upload-Offset
+//	DELETE /:id         terminate the upload
+//	OPTIONS /           the protocol versions and extensions
+//
+// the uploads not completed within the Expiry are removed, they are swept
+// as the uploads are accessed. a chunk is stored whole or not at all, the
+// received prefix of an interrupted PATCH is dropped and the client
+// resumes from the end of the last complete chunk, the Upload-Offset of
+// HEAD, so small chunks lose less on the unreliable networks.
+type Uploads struct {
+	Storage storage.Storage
+	// MaxSize limits the Upload-Length, 0 means no limit.
+	MaxSize int64
+	// Expiry of the abandoned uploads since the last chunk, default 24h.
+	Expiry time.Duration
+	// OnComplete is called when the last chunk is stored.
+	OnComplete func(c ReqCxtI, u *Upload)
+
+	mu      sync.Mutex
+	uploads map[string]*Upload
+	swept   time.Time
+}
+
+// NewUploads return the Uploads of the storage.
+func NewUploads(s storage.Storage) *Uploads {
+	return &Uploads{Storage: s, Expiry: 24 * time.Hour, uploads: make(map[string]*Upload)}
+}
+
+// Mount register the upload routes on the group, e.g.
+// NewUploads(s).Mount(ctx.Group("/files")).
+func (u *Uploads) Mount(g GroupI) {
+	g.Register("options", "/", u.options)
+	g.Register("post", "/", u.create)
+	g.Register("head", "/:id", u.head)
+	g.Register("patch", "/:id", u.patch)
+	g.Register("delete", "/:id", u.terminate)
+}
+
+// DataKey return the storage key of the assembled file.
+func (up *Upload) DataKey() string {
+	return up.ID + "/data"
+}
+
+func (up *Upload) infoKey() string {
+	return up.ID + "/info"
+}
+
+func (up *Upload) chunkKey(offset int64) string {
+	return fmt.Sprintf("%s/chunk-%020d", up.ID, offset)
+}
+
+// Done report whether every byte has been received.
+func (up *Upload) Done() bool {
+	if up.mu != nil {
+		up.mu.Lock()
+		defer up.mu.Unlock()
+	}
+	return up.done()
+}
+
+func (up *Upload) done() bool {
+	return up.Offset == up.Length
+}
+
+func (u *Uploads) expiry() time.Duration {
+	if u.Expiry <= 0 {
+		return 24 * time.Hour
+	}
+	return u.Expiry
+}
+
+// tusHeaders set the protocol headers of every response.
+func tusHeaders(c ReqCxtI) bool {
+	c.SetHeader("Tus-Resumable", tusVersion)
+	c.SetHeader("Cache-Control", "no-store")
+	if v := c.GetHeader("Tus-Resumable"); v != "" && v != tusVersion {
+		c.SetHeader("Tus-Version", tusVersion)
+		c.Abort(412, "unsupported tus version "+v)
+		return false
+	}
+	return true
+}
+
+func (u *Uploads) options(c ReqCxtI) {
+	c.SetHeader("Tus-Resumable", tusVersion)
+	c.SetHeader("Tus-Version", tusVersion)
+	c.SetHeader("Tus-Extension", tusExtensions)
+	if u.MaxSize > 0 {
+		c.SetHeader("Tus-Max-Size", strconv.FormatInt(u.MaxSize, 10))
+	}
+	c.Status(204)
+}
+
+func (u *Uploads) create(c ReqCxtI) {
+	if !tusHeaders(c) {
+		return
+	}
+	u.sweep()
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.Abort(400, "invalid Upload-Length")
+		return
+	}
+	if u.MaxSize > 0 && length > u.MaxSize {
+		c.Abort(413, "Upload-Length exceeds "+strconv.FormatInt(u.MaxSize, 10))
+		return
+	}
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.Abort(400, "invalid Upload-Metadata")
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		c.Abort(500, err.Error())
+		return
+	}
+	up := &Upload{
+		ID:       hex.EncodeToString(id),
+		Length:   length,
+		Metadata: metadata,
+		Expires:  time.Now().Add(u.expiry()),
+		mu:       &u.mu,
+	}
+	if err := u.save(up); err != nil {
+		c.Abort(500, err.Error())
+		return
+	}
+	u.mu.Lock()
+	u.uploads[up.ID] = up
+	u.mu.Unlock()
+
+	c.SetHeader("Location", strings.TrimSuffix(c.Request().URL.Path, "/")+"/"+up.ID)
+	c.SetHeader("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	if up.Done() && !u.complete(c, up) {
+		return
+	}
+	c.Status(201)
+}
+
+func (u *Uploads) head(c ReqCxtI) {
+	if !tusHeaders(c) {
+		return
+	}
+	up := u.get(c)
+	if up == nil {
+		return
+	}
+	u.mu.Lock()
+	offset, expires := up.Offset, up.Expires
+	u.mu.Unlock()
+	c.SetHeader("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.SetHeader("Upload-Length", strconv.FormatInt(up.Length, 10))
+	c.SetHeader("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	c.Status(200)
+}
+
+func (u *Uploads) patch(c ReqCxtI) {
+	if !tusHeaders(c) {
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type")); mt != MIMEOffsetOctetStream {
+		c.Abort(415, "Content-Type must be "+MIMEOffsetOctetStream)
+		return
+	}
+	up := u.get(c)
+	if up == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.Abort(400, "invalid Upload-Offset")
+		return
+	}
+
+	u.mu.Lock()
+	switch {
+	case up.busy:
+		u.mu.Unlock()
+		c.Abort(423, "upload is locked by another request")
+		return
+	case offset != up.Offset:
+		u.mu.Unlock()
+		c.SetHeader("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+		c.Abort(409, "Upload-Offset mismatch")
+		return
+	}
+	up.busy = true
+	remain := up.Length - up.Offset
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		up.busy = false
+		u.mu.Unlock()
+	}()
+
+	size := c.Request().ContentLength
+	if size > remain {
+		c.Abort(413, "chunk exceeds Upload-Length")
+		return
+	}
+	if size < 0 {
+		// unknown
+		size = 0
+	}
+	// the interrupted chunk is dropped, see Uploads.
+	body := &limitedBody{ReadCloser: c.Body(), remain: remain}
+	obj, err := u.Storage.Put(up.chunkKey(offset), body, storage.Meta{Size: size})
+	if err != nil {
+		if se, ok := err.(*SecurityError); ok {
+			c.Abort(se.Status, se.Reason)
+			return
+		}
+		logger.Log.Error("upload %s chunk at %d: %v", up.ID, offset, err)
+		c.Abort(500, "store chunk failed")
+		return
+	}
+
+	u.mu.Lock()
+	if obj.Size > 0 {
+		up.Chunks = append(up.Chunks, offset)
+		up.Offset += obj.Size
+	}
+	up.Expires = time.Now().Add(u.expiry())
+	u.mu.Unlock()
+	if err := u.save(up); err != nil {
+		logger.Log.Error("upload %s info: %v", up.ID, err)
+	}
+	if up.Done() && !u.complete(c, up) {
+		return
+	}
+	u.mu.Lock()
+	offset, expires := up.Offset, up.Expires
+	u.mu.Unlock()
+	c.SetHeader("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.SetHeader("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	c.Status(204)
+}
+
+func (u *Uploads) terminate(c ReqCxtI) {
+	if !tusHeaders(c) {
+		return
+	}
+	up := u.get(c)
+	if up == nil {
+		return
+	}
+	u.remove(up)
+	c.Status(204)
+}
+
+// get return the unexpired upload of the id param, the request is
+// aborted when it is absent.
+func (u *Uploads) get(c ReqCxtI) *Upload {
+	// the upload of the id answers 410 before the others are swept.
+	defer u.sweep()
+	id := c.GetParam("id")
+	u.mu.Lock()
+	up, ok := u.uploads[id]
+	u.mu.Unlock()
+	if !ok {
+		// the upload created before the restart.
+		up = u.load(id)
+	}
+	if up == nil {
+		c.Abort(404, "upload not found")
+		return nil
+	}
+	u.mu.Lock()
+	expired := !up.done() && time.Now().After(up.Expires)
+	u.mu.Unlock()
+	if expired {
+		u.remove(up)
+		c.Abort(410, "upload expired")
+		return nil
+	}
+	return up
+}
+
+// complete assemble the chunks to the data, the chunks are removed.
+// the request is aborted on failure.
+func (u *Uploads) complete(c ReqCxtI, up *Upload) bool {
+	readers := make([]io.Reader, 0, len(up.Chunks))
+	closers := make([]io.Closer, 0, len(up.Chunks))
+	defer func() {
+		for _, rc := range closers {
+			_ = rc.Close()
+		}
+	}()
+	for _, offset := range up.Chunks {
+		r, _, err := u.Storage.Open(up.chunkKey(offset))
+		if err != nil {
+			logger.Log.Error("upload %s open chunk at %d: %v", up.ID, offset, err)
+			c.Abort(500, "assemble upload failed")
+			return false
+		}
+		readers = append(readers, r)
+		closers = append(closers, r)
+	}
+	meta := storage.Meta{Size: up.Length, ContentType: up.Metadata["filetype"]}
+	if _, err := u.Storage.Put(up.DataKey(), io.MultiReader(readers...), meta); err != nil {
+		logger.Log.Error("upload %s assemble: %v", up.ID, err)
+		c.Abort(500, "assemble upload failed")
+		return false
+	}
+	for _, offset := range up.Chunks {
+		_ = u.Storage.Delete(up.chunkKey(offset))
+	}
+	u.mu.Lock()
+	up.Chunks = nil
+	u.mu.Unlock()
+	_ = u.save(up)
+	if u.OnComplete != nil {
+		u.OnComplete(c, up)
+	}
+	return true
+}
+
+// sweep the expired uploads once a quarter of the Expiry, at most once
+// a minute.
+func (u *Uploads) sweep() {
+	every := u.expiry() / 4
+	if every > time.Minute {
+		every = time.Minute
+	}
+	now := time.Now()
+	u.mu.Lock()
+	due := now.Sub(u.swept) >= every
+	if due {
+		u.swept = now
+	}
+	u.mu.Unlock()
+	if due {
+		u.Sweep()
+	}
+}
+
+// Sweep remove the expired uploads, it runs as the uploads are accessed,
+// it can be called by a ticker too.
+func (u *Uploads) Sweep() {
+	now := time.Now()
+	var expired []*Upload
+	u.mu.Lock()
+	for _, up := range u.uploads {
+		if !up.done() && !up.busy && now.After(up.Expires) {
+			expired = append(expired, up)
+		}
+	}
+	u.mu.Unlock()
+	for _, up := range expired {
+		u.remove(up)
+	}
+}
+
+func (u *Uploads) remove(up *Upload) {
+	u.mu.Lock()
+	delete(u.uploads, up.ID)
+	chunks := up.Chunks
+	u.mu.Unlock()
+	for _, offset := range chunks {
+		_ = u.Storage.Delete(up.chunkKey(offset))
+	}
+	_ = u.Storage.Delete(up.DataKey())
+	_ = u.Storage.Delete(up.infoKey())
+}
+
+// save persist the upload state beside the chunks.
+func (u *Uploads) save(up *Upload) error {
+	u.mu.Lock()
+	bs, err := json.Marshal(up)
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = u.Storage.Put(up.infoKey(), strings.NewReader(string(bs)), storage.Meta{ContentType: MIMEJSON, Size: int64(len(bs))})
+	return err
+}
+
+func (u *Uploads) load(id string) *Upload {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return nil
+	}
+	r, _, err := u.Storage.Open(id + "/info")
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	up := &Upload{mu: &u.mu}
+	if err := json.Unmarshal(bs, up); err != nil || up.ID != id {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if cur, ok := u.uploads[id]; ok {
+		return cur
+	}
+	u.uploads[id] = up
+	return up
+}
+
+// parseUploadMetadata parse the "key base64value" pairs separated by ",".
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 1:
+			metadata[kv[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[kv[0]] = string(v)
+		default:
+			return nil, fmt.Errorf("invalid metadata %q", pair)
+		}
+	}
+	return metadata, nil
+}
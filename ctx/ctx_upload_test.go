@@ -0,0 +1,134 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huaxr/rx/ctx/storage"
+)
+
+var tusStore = storage.NewMemory()
+
+var tusUploads = NewUploads(tusStore)
+
+func init() {
+	tusUploads.Mount(Group("/tus"))
+}
+
+func tus(t *testing.T, method, url string, header map[string]string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	return rsp
+}
+
+func TestResumableUpload(t *testing.T) {
+	addr := "http://" + serve(t)
+	rsp := tus(t, "POST", addr+"/tus", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename aGVsbG8udHh0,filetype dGV4dC9wbGFpbg==",
+	}, "")
+	location := rsp.Header.Get("Location")
+	if rsp.StatusCode != 201 || !strings.HasPrefix(location, "/tus/") || rsp.Header.Get("Tus-Resumable") != "1.0.0" {
+		t.Fatalf("create: %d %v", rsp.StatusCode, rsp.Header)
+	}
+	id := strings.TrimPrefix(location, "/tus/")
+
+	patch := func(offset int, chunk string) *http.Response {
+		return tus(t, "PATCH", addr+location, map[string]string{
+			"Content-Type":  MIMEOffsetOctetStream,
+			"Upload-Offset": strconv.Itoa(offset),
+		}, chunk)
+	}
+	if rsp = patch(0, "hello "); rsp.StatusCode != 204 || rsp.Header.Get("Upload-Offset") != "6" {
+		t.Fatalf("patch: %d %v", rsp.StatusCode, rsp.Header)
+	}
+	if rsp = patch(0, "hello "); rsp.StatusCode != 409 {
+		t.Fatalf("stale offset: %d", rsp.StatusCode)
+	}
+	if rsp = patch(6, "world and more"); rsp.StatusCode != 413 {
+		t.Fatalf("oversized chunk: %d", rsp.StatusCode)
+	}
+	// the prefix of the interrupted chunk is dropped.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("PATCH " + location + " HTTP/1.1\r\nHost: x\r\nTus-Resumable: 1.0.0\r\n" +
+		"Content-Type: " + MIMEOffsetOctetStream + "\r\nUpload-Offset: 6\r\nContent-Length: 5\r\n\r\nwo"))
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	rsp = tus(t, "HEAD", addr+location, nil, "")
+	if rsp.StatusCode != 200 || rsp.Header.Get("Upload-Offset") != "6" || rsp.Header.Get("Upload-Length") != "11" {
+		t.Fatalf("head: %d %v", rsp.StatusCode, rsp.Header)
+	}
+	if rsp = patch(6, "world"); rsp.StatusCode != 204 || rsp.Header.Get("Upload-Offset") != "11" {
+		t.Fatalf("last patch: %d %v", rsp.StatusCode, rsp.Header)
+	}
+	r, obj, err := tusStore.Open(id + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "hello world" || obj.ContentType != "text/plain" {
+		t.Fatalf("assembled %q %+v", b, obj)
+	}
+	if _, err := tusStore.Stat(id + "/chunk-00000000000000000000"); err != storage.ErrNotExist {
+		t.Fatalf("chunk kept: %v", err)
+	}
+
+	if rsp = tus(t, "DELETE", addr+location, nil, ""); rsp.StatusCode != 204 {
+		t.Fatalf("delete: %d", rsp.StatusCode)
+	}
+	if rsp = tus(t, "HEAD", addr+location, nil, ""); rsp.StatusCode != 404 {
+		t.Fatalf("head deleted: %d", rsp.StatusCode)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	addr := "http://" + serve(t)
+	tusUploads.Expiry = 20 * time.Millisecond
+	defer func() { tusUploads.Expiry = 24 * time.Hour }()
+
+	rsp := tus(t, "POST", addr+"/tus", map[string]string{"Upload-Length": "5"}, "")
+	location := rsp.Header.Get("Location")
+	time.Sleep(30 * time.Millisecond)
+	if rsp = tus(t, "HEAD", addr+location, nil, ""); rsp.StatusCode != 410 {
+		t.Fatalf("expired: %d", rsp.StatusCode)
+	}
+	if _, err := tusStore.Stat(strings.TrimPrefix(location, "/tus/") + "/info"); err != storage.ErrNotExist {
+		t.Fatalf("expired upload kept: %v", err)
+	}
+	// the expired uploads are swept by the access to the others.
+	rsp = tus(t, "POST", addr+"/tus", map[string]string{"Upload-Length": "5"}, "")
+	location = rsp.Header.Get("Location")
+	time.Sleep(30 * time.Millisecond)
+	if rsp = tus(t, "HEAD", addr+"/tus/unknown", nil, ""); rsp.StatusCode != 404 {
+		t.Fatalf("unknown: %d", rsp.StatusCode)
+	}
+	if _, err := tusStore.Stat(strings.TrimPrefix(location, "/tus/") + "/info"); err != storage.ErrNotExist {
+		t.Fatalf("expired upload not swept: %v", err)
+	}
+	if rsp = tus(t, "POST", addr+"/tus", map[string]string{"Upload-Length": "5", "Tus-Resumable": "0.2.0"}, ""); rsp.StatusCode != 412 {
+		t.Fatalf("version: %d", rsp.StatusCode)
+	}
+}
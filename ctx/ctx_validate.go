@@ -0,0 +1,337 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package ctx
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Validator validates the bound struct, it runs after the binding of
+// ParseBody and the Bind methods. return ValidationErrors to respond the
+// field errors, other errors are responded as the message of 422.
+type Validator interface {
+	Validate(dst interface{}) error
+}
+
+var validator Validator = tagValidator{}
+
+// SetValidator replace the rx tag validator, nil disables the validation.
+func SetValidator(v Validator) {
+	validator = v
+}
+
+// FieldError is the failed rule of a field, Path is the json path of the
+// field, e.g. "items[0].name".
+type FieldError struct {
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is every field error of the struct.
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(ve))
+	for _, fe := range ve {
+		msgs = append(msgs, fe.Path+": "+fe.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Rule report whether the field value satisfies the rule with the param,
+// the param is the text after "=" in the tag.
+type Rule func(v reflect.Value, param string) bool
+
+var (
+	ruleLock sync.RWMutex
+	rules    = map[string]Rule{
+		"required": ruleRequired,
+		"min":      ruleMin,
+		"max":      ruleMax,
+		"len":      ruleLen,
+		"email":    ruleEmail,
+		"oneof":    ruleOneOf,
+	}
+)
+
+// RegisterRule register the custom rule of the rx tag,
+// e.g. RegisterRule("even", func(v reflect.Value, _ string) bool { return v.Int()%2 == 0 })
+func RegisterRule(name string, rule Rule) {
+	ruleLock.Lock()
+	rules[name] = rule
+	ruleLock.Unlock()
+}
+
+func getRule(name string) (Rule, bool) {
+	ruleLock.RLock()
+	defer ruleLock.RUnlock()
+	r, ok := rules[name]
+	return r, ok
+}
+
+// tagValidator validates the rx tags: `rx:"required,min=1,max=64,email,oneof=a b"`.
+// the rules are skipped for the zero value of omitempty and the nil pointer.
+type tagValidator struct{}
+
+func (tagValidator) Validate(dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	var errs ValidationErrors
+	validateValue(v, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateSource validate the fields tagged by the source, with the
+// fields of the embedded structs.
+func (tagValidator) validateSource(dst interface{}, tag string) error {
+	v := reflect.ValueOf(dst)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	var errs ValidationErrors
+	validateSourceFields(v, "", tag, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateSourceFields(v reflect.Value, path, tag string, errs *ValidationErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		f := v.Field(i)
+		if sf.Anonymous && sf.Tag.Get(tag) == "" {
+			for f.Kind() == reflect.Ptr && !f.IsNil() {
+				f = f.Elem()
+			}
+			if f.Kind() == reflect.Struct {
+				validateSourceFields(f, path, tag, errs)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name := sf.Tag.Get(tag); name == "" || name == "-" {
+			continue
+		}
+		fpath := joinPath(path, jsonName(sf))
+		if rule := sf.Tag.Get("rx"); rule != "" && rule != "-" {
+			validateField(f, fpath, rule, errs)
+		}
+		validateValue(f, fpath, errs)
+	}
+}
+
+func validateValue(v reflect.Value, path string, errs *ValidationErrors) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		validateStruct(v, path, errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			validateValue(iter.Value(), joinPath(path, fmt.Sprint(iter.Key().Interface())), errs)
+		}
+	}
+}
+
+func validateStruct(v reflect.Value, path string, errs *ValidationErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+		f := v.Field(i)
+		// the fields of the embedded struct are promoted.
+		if sf.Anonymous && sf.Tag.Get("json") == "" {
+			validateValue(f, path, errs)
+			continue
+		}
+		name := jsonName(sf)
+		if name == "-" {
+			continue
+		}
+		fpath := joinPath(path, name)
+		if tag := sf.Tag.Get("rx"); tag != "" && tag != "-" {
+			validateField(f, fpath, tag, errs)
+		}
+		validateValue(f, fpath, errs)
+	}
+}
+
+func validateField(f reflect.Value, path, tag string, errs *ValidationErrors) {
+	items := strings.Split(tag, ",")
+	for _, item := range items {
+		if item == "omitempty" && f.IsZero() {
+			return
+		}
+	}
+	for _, item := range items {
+		name, param := item, ""
+		if idx := strings.Index(item, "="); idx >= 0 {
+			name, param = item[:idx], item[idx+1:]
+		}
+		if name == "" || name == "omitempty" {
+			continue
+		}
+		rule, ok := getRule(name)
+		if !ok {
+			*errs = append(*errs, FieldError{Path: path, Rule: name, Param: param, Message: "unknown rule " + name})
+			continue
+		}
+		if name == "required" {
+			if !rule(f, param) {
+				*errs = append(*errs, FieldError{Path: path, Rule: name, Message: ruleMessage(name, param)})
+				return
+			}
+			continue
+		}
+		// the absent optional value is not validated.
+		if v := indirect(f); v.Kind() != reflect.Ptr && !rule(v, param) {
+			*errs = append(*errs, FieldError{Path: path, Rule: name, Param: param, Message: ruleMessage(name, param)})
+		}
+	}
+}
+
+func ruleMessage(name, param string) string {
+	switch name {
+	case "required":
+		return "is required"
+	case "min":
+		return "must be at least " + param
+	case "max":
+		return "must be at most " + param
+	case "len":
+		return "length must be " + param
+	case "email":
+		return "must be a valid email"
+	case "oneof":
+		return "must be one of [" + param + "]"
+	}
+	if param != "" {
+		return "failed on " + name + "=" + param
+	}
+	return "failed on " + name
+}
+
+func jsonName(sf reflect.StructField) string {
+	name := sf.Tag.Get("json")
+	if idx := strings.Index(name, ","); idx >= 0 {
+		name = name[:idx]
+	}
+	if name == "" {
+		name = sf.Name
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func ruleRequired(v reflect.Value, _ string) bool {
+	return !v.IsZero()
+}
+
+// size return the number for the numbers, the rune count of the strings
+// and the length of the containers.
+func size(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func compare(v reflect.Value, param string, ok func(n, p float64) bool) bool {
+	p, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return false
+	}
+	n, valid := size(v)
+	return valid && ok(n, p)
+}
+
+func ruleMin(v reflect.Value, param string) bool {
+	return compare(v, param, func(n, p float64) bool { return n >= p })
+}
+
+func ruleMax(v reflect.Value, param string) bool {
+	return compare(v, param, func(n, p float64) bool { return n <= p })
+}
+
+func ruleLen(v reflect.Value, param string) bool {
+	return compare(v, param, func(n, p float64) bool { return n == p })
+}
+
+func ruleEmail(v reflect.Value, _ string) bool {
+	if v.Kind() != reflect.String {
+		return false
+	}
+	addr, err := mail.ParseAddress(v.String())
+	return err == nil && addr.Address == v.String()
+}
+
+func ruleOneOf(v reflect.Value, param string) bool {
+	val := fmt.Sprint(v.Interface())
+	for _, opt := range strings.Fields(param) {
+		if val == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -31,6 +31,10 @@ type loopServer struct {
 
 	typ TYPE
 
+	// woken the connections with responses queued off the loop.
+	wakeLock sync.Mutex
+	woken    []*conn
+
 	//wg sync.WaitGroup
 	//handlers map[string][]engine.HandlerFunc
 	//groupHandlers engine.HandlerFunc
@@ -42,6 +46,7 @@ func (srv *loopServer) Run() {
 }
 
 func (srv *loopServer) execute(fd int) error {
+	srv.flush()
 	c := srv.connections[fd]
 	switch {
 	case c == nil:
@@ -72,12 +77,14 @@ func (srv *loopServer) loopConnect(fd int) error {
 			return err
 		}
 		//c := &conn{fd: nfd, sa: sa}
-		c := &conn{sock: nfd}
+		c := &conn{sock: nfd, srv: srv}
 
 		c.out = nil
 		c.in = nil
+		c.drained = sync.NewCond(&c.mu)
 
 		c.connInfo = SockaddrToAddr(sa)
+		c.ec = ctx.NewEPollConn(c)
 		srv.connections[c.sock] = c
 		srv.poll.AddRW(c.sock)
 		srv.count.Inc()
@@ -106,6 +113,7 @@ func (srv *loopServer) loopWrite(c *conn) error {
 		return srv.closeConn(c)
 	}
 	c.out = c.out[n:]
+	c.sent(n)
 	if len(c.out) == 0 {
 		srv.poll.ChangeRead(c.sock)
 	}
@@ -116,6 +124,10 @@ func (srv *loopServer) closeConn(c *conn) error {
 	srv.count.Dec()
 	delete(srv.connections, c.sock)
 	_ = syscall.Close(c.sock)
+	c.mu.Lock()
+	c.closed = true
+	c.drained.Broadcast()
+	c.mu.Unlock()
 	return nil
 }
 
@@ -158,20 +170,10 @@ func (srv *loopServer) loopRead(c *conn) error {
 		}
 		return srv.closeConn(c)
 	}
-	c.in = in[:n]
-	// handler write
-	if len(c.in) == 1 || string(c.in) == "" {
-		return nil
-	}
-
-	//reqContext := wrapRequest(c.in)
-	//reqContext.mod = EPoll
-	//putContext(reqContext)
-	//reqContext.setClientAddr(c.connInfo)
-	//
-	//res := reqContext.execute()
-	//c.out = res.rspToBytes()
-	c.out = ctx.WapEPoll(c.in)
+	// the requests are buffered until complete, the pipelined
+	// requests are executed in order and their responses queued.
+	c.ec.Serve(in[:n])
+	srv.flush()
 
 	if len(c.out) != 0 || c.signal != None {
 		srv.poll.ChangeRW(c.sock)
@@ -179,6 +181,47 @@ func (srv *loopServer) loopRead(c *conn) error {
 	return nil
 }
 
+// wake the loop to send the responses queued off the loop.
+func (srv *loopServer) wake(c *conn) {
+	srv.wakeLock.Lock()
+	srv.woken = append(srv.woken, c)
+	srv.wakeLock.Unlock()
+	_ = srv.poll.Trigger(nil)
+}
+
+// flush run the work queued off the loop and move the queued responses
+// to the output on the loop.
+func (srv *loopServer) flush() {
+	srv.wakeLock.Lock()
+	woken := srv.woken
+	srv.woken = nil
+	srv.wakeLock.Unlock()
+
+	for _, c := range woken {
+		if srv.connections[c.sock] != c {
+			// closed already
+			continue
+		}
+		c.mu.Lock()
+		tasks := c.tasks
+		c.tasks = nil
+		c.mu.Unlock()
+		for _, f := range tasks {
+			f()
+		}
+		c.mu.Lock()
+		c.out = append(c.out, c.pending...)
+		c.pending = nil
+		if c.closing {
+			c.signal = Close
+		}
+		c.mu.Unlock()
+		if len(c.out) != 0 || c.signal != None {
+			srv.poll.ChangeRW(c.sock)
+		}
+	}
+}
+
 func (srv *loopServer) Count() int32 {
 	return srv.count.Load()
 }
@@ -5,7 +5,12 @@
 package engine
 
 import (
+	"io"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/huaxr/rx/ctx"
 
 	"go.uber.org/atomic"
 )
@@ -33,8 +38,91 @@ type conn struct {
 	signal Signal
 
 	connInfo net.Addr
+
+	// ec parses the requests of the input in order.
+	ec  *ctx.EPollConn
+	srv *loopServer
+
+	// pending the responses completed off the loop, moved to out by
+	// the loop, closing closes the connection after they are sent.
+	mu      sync.Mutex
+	pending []byte
+	closing bool
+	// tasks the work queued off the loop to run on it.
+	tasks []func()
+	// queued the bytes of pending and out not sent yet, drained is
+	// signaled once they are sent or the connection is closed.
+	queued  int
+	closed  bool
+	drained *sync.Cond
 }
 
 func (c *conn) isOpen() bool {
 	return c.opened.Load()
 }
+
+// Write queue the response for the loop, it's called off the loop.
+func (c *conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	c.pending = append(c.pending, b...)
+	c.queued += len(b)
+	c.mu.Unlock()
+	c.srv.wake(c)
+	return len(b), nil
+}
+
+// Close the connection after the queued responses are sent.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	c.srv.wake(c)
+	return nil
+}
+
+// Loop queue f to run on the loop, the requests read ahead are served
+// by it once the previous ones complete off the loop.
+func (c *conn) Loop(f func()) {
+	c.mu.Lock()
+	c.tasks = append(c.tasks, f)
+	c.mu.Unlock()
+	c.srv.wake(c)
+}
+
+// Drain wait until the bytes queued are at most n, the streams write
+// the next chunk after it. false is returned once the connection is
+// closed or the deadline passes.
+func (c *conn) Drain(n int, deadline time.Time) bool {
+	// the Cond can't wait with a timeout, the timer wakes it.
+	t := time.AfterFunc(time.Until(deadline), func() {
+		c.mu.Lock()
+		c.drained.Broadcast()
+		c.mu.Unlock()
+	})
+	defer t.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.queued > n && !c.closed {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		c.drained.Wait()
+	}
+	return !c.closed
+}
+
+// sent account the bytes written by the loop.
+func (c *conn) sent(n int) {
+	c.mu.Lock()
+	c.queued -= n
+	c.drained.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.connInfo
+}
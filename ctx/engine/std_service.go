@@ -8,12 +8,12 @@ import (
 	"net"
 	"runtime"
 	"runtime/debug"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/huaxr/rx/ctx"
+	"github.com/huaxr/rx/internal"
 
 	"github.com/huaxr/rx/logger"
 )
@@ -27,6 +27,10 @@ const (
 
 // TcpSocket the raw socket
 type stdServer struct {
+	// queued the connections waiting for a dispatch worker, it's first
+	// for the 64 bit alignment of the atomic.
+	queued int64
+
 	//reader io.Reader
 	listener net.Listener
 
@@ -42,6 +46,14 @@ type stdServer struct {
 	typ TYPE
 }
 
+// Stats is the snapshot of the running stdServer.
+type Stats struct {
+	Qps        int
+	Goroutine  int
+	QueueDepth int
+	Limiters   []ctx.LimiterStats
+}
+
 const qpsPeriod = 1
 const hbPeriod = 10
 const LB = 1 << 6
@@ -67,6 +79,7 @@ func NewStdServer(addr string) *stdServer {
 		}
 		t.tickQps = time.NewTicker(qpsPeriod * time.Second)
 		t.tickHb = time.NewTicker(hbPeriod * time.Second)
+		ctx.SetQueueDepth(t.queueDepth)
 		go t.heartBeat()
 		t.do()
 	})
@@ -91,6 +104,9 @@ func (t *stdServer) heartBeat() {
 			var ms runtime.MemStats
 			runtime.ReadMemStats(&ms)
 			logger.Log.Info("current goroutine count: %d; MemStates: Alloc:%d(MB) HeapIdle:%d(MB) HeapInuse:%d(MB)", g_num, ms.Alloc/(1024*1024), ms.HeapIdle/(1024*1024), ms.HeapInuse/(1024*1024))
+			for _, l := range ctx.GetLimiterStats() {
+				logger.Log.Info("limiter %s: limit:%d inflight:%d queue:%d admitted:%d rejected:%d", l.Name, l.Limit, l.Inflight, l.QueueDepth, l.Admitted, l.Rejected)
+			}
 			// force gc.
 			//runtime.GC()
 			debug.FreeOSMemory()
@@ -98,6 +114,29 @@ func (t *stdServer) heartBeat() {
 	}
 }
 
+// queueDepth return the connections waiting for a dispatch worker, it's
+// read by the limiter on each request.
+func (t *stdServer) queueDepth() int {
+	return int(atomic.LoadInt64(&t.queued))
+}
+
+// enqueue hand the connection to the dispatch workers.
+func (t *stdServer) enqueue(channel chan net.Conn, c net.Conn) {
+	atomic.AddInt64(&t.queued, 1)
+	channel <- c
+}
+
+// Stats return the qps, goroutine, dispatch queue depth and load
+// shedding stats of the server.
+func (t *stdServer) Stats() Stats {
+	return Stats{
+		Qps:        t.qps,
+		Goroutine:  t.goroutine,
+		QueueDepth: t.queueDepth(),
+		Limiters:   ctx.GetLimiterStats(),
+	}
+}
+
 func (t *stdServer) Run() {
 	ctx.Print()
 	logger.Log.Info("start server on: %v", t.GetAddr())
@@ -108,12 +147,9 @@ func (t *stdServer) Run() {
 			logger.Log.Error("Err listening, %v", err.Error())
 			continue
 		}
-		ip := rawConn.RemoteAddr().String()
-		ip = strings.ReplaceAll(ip[len(ip)-9:], ".", "")
-		ip = strings.ReplaceAll(ip, ":", "")
-		lb, _ := strconv.Atoi(ip)
+		lb := internal.CRC(rawConn.RemoteAddr().String())
 		// multiple channel can enhance the performance
-		t.ch[lb%LB] <- rawConn
+		t.enqueue(t.ch[lb%LB], rawConn)
 	}
 }
 
@@ -127,7 +163,12 @@ func (t *stdServer) do() {
 		go func() {
 			for {
 				c := <-channel
-				ctx.WrapStd(c, string(t.typ))
+				atomic.AddInt64(&t.queued, -1)
+				// the persistent connection is dispatched back to the
+				// workers when it's next request arrives.
+				ctx.ServeStd(c, string(t.typ), func(c net.Conn) {
+					t.enqueue(channel, c)
+				})
 				t.count++
 			}
 		}()
@@ -33,10 +33,26 @@ type router struct {
 	handler []handlerFunc
 	url     string
 	method  string
+	// segments of the url with ":name" params.
+	segments []string
+	// expect the header phase checks.
+	expect SecurityChain
+	// decompress overrides the Config.Decompress of the route.
+	decompress *DecompressConfig
+}
+
+// Param is the value of the ":name" segment of the route.
+type Param struct {
+	Key   string
+	Value string
 }
 
 var handlerSlice = make(map[int]*router)
 
+// paramRouters the routers with params, they are matched in registration
+// order when the static route of the path is absent.
+var paramRouters []*router
+
 func Print() {
 	banner.PrintBanner()
 	for _, v := range handlerSlice {
@@ -54,4 +70,57 @@ func Register(method, path string, handlerFuncs ...handlerFunc) {
 	r.url = path
 	r.method = method
 	handlerSlice[p] = r
+	if strings.Contains(path, "/:") {
+		r.segments = strings.Split(path, "/")
+		paramRouters = append(paramRouters, r)
+	}
+}
+
+// mustRouter return the registered router of the route, panic when it's
+// not registered.
+func mustRouter(caller, method, path string) *router {
+	path = strings.TrimSuffix(path, "/")
+	r, ok := handlerSlice[internal.CRC(fmt.Sprintf("%s::", method)+path)]
+	if !ok {
+		panic(caller + ": route " + method + " " + path + " not registered")
+	}
+	return r
+}
+
+// routerOf return the router of the request.
+func routerOf(method, path string) *router {
+	if r, ok := handlerSlice[internal.CRC(fmt.Sprintf("%s::", strings.ToLower(method))+path)]; ok {
+		return r
+	}
+	r, _ := matchRouter(method, path)
+	return r
+}
+
+// matchRouter return the router with params matching the path.
+func matchRouter(method, path string) (*router, []Param) {
+	if strings.HasSuffix(path, "/") {
+		path = path[:len(path)-1]
+	}
+	segments := strings.Split(path, "/")
+	for _, r := range paramRouters {
+		if !strings.EqualFold(r.method, method) || len(r.segments) != len(segments) {
+			continue
+		}
+		var params []Param
+		matched := true
+		for i, seg := range r.segments {
+			if strings.HasPrefix(seg, ":") && segments[i] != "" {
+				params = append(params, Param{Key: seg[1:], Value: segments[i]})
+				continue
+			}
+			if seg != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return r, params
+		}
+	}
+	return nil, nil
 }
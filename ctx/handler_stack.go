@@ -29,10 +29,16 @@ type (
 // For each request the has it's own stack to execute
 func copyStack(str string) *stack {
 	router, ok := handlerSlice[internal.CRC(str)]
-	if !ok || len(router.handler) == 0 {
+	if !ok {
 		return nil
 	}
+	return routerStack(router)
+}
 
+func routerStack(router *router) *stack {
+	if len(router.handler) == 0 {
+		return nil
+	}
 	s := newStack()
 	for l := len(router.handler) - 1; l >= 0; l-- {
 		s.Push(router.handler[l])
@@ -80,3 +86,25 @@ func (this *stack) Push(value handlerFunc) {
 	this.top = n
 	this.length.Inc()
 }
+
+// mark is the snapshot of a stack, the nodes are never mutated
+// after pushed so that the top pointer snapshots the whole stack.
+type mark struct {
+	top    *node
+	length int32
+}
+
+// Mark return the snapshot of the stack
+func (this *stack) Mark() mark {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return mark{this.top, this.length.Load()}
+}
+
+// Reset the stack to the snapshot
+func (this *stack) Reset(m mark) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.top = m.top
+	this.length.Store(m.length)
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores the objects as the files under the root, the keys are
+// the slash separated paths relative to the root.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// path return the file path of the key, the key can't escape the root.
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + strings.Replace(key, "\\", "/", -1))
+	if clean == "/" {
+		return "", ErrKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+// Put write the content to a temp file and rename it to the key once
+// verified, so a failed put leaves the existing object.
+func (l *Local) Put(key string, r io.Reader, meta Meta) (*Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".rx-put-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hr := newHashReader(r)
+	_, err = io.Copy(tmp, hr)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := hr.verify(meta); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return nil, err
+	}
+	obj, err := l.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	obj.SHA256 = hr.sum()
+	if meta.ContentType != "" {
+		obj.ContentType = meta.ContentType
+	}
+	return obj, nil
+}
+
+func (l *Local) Open(key string) (io.ReadCloser, *Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, notExist(err)
+	}
+	obj, err := l.Stat(key)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, obj, nil
+}
+
+func (l *Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return notExist(os.Remove(p))
+}
+
+// Stat return the object of the file, the content type is derived from
+// the extension and the checksum is not kept.
+func (l *Local) Stat(key string) (*Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	if fi.IsDir() {
+		return nil, ErrNotExist
+	}
+	return &Object{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(p)),
+		ModTime:     fi.ModTime(),
+	}, nil
+}
+
+func notExist(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
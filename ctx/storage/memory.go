@@ -0,0 +1,95 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Memory keeps the objects in memory, for the tests.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]*memObject
+}
+
+type memObject struct {
+	obj  Object
+	data []byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]*memObject)}
+}
+
+func (m *Memory) Put(key string, r io.Reader, meta Meta) (*Object, error) {
+	if key == "" {
+		return nil, ErrKey
+	}
+	hr := newHashReader(r)
+	data, err := ioutil.ReadAll(hr)
+	if err != nil {
+		return nil, err
+	}
+	if err := hr.verify(meta); err != nil {
+		return nil, err
+	}
+	mo := &memObject{
+		obj: Object{
+			Key:         key,
+			Size:        int64(len(data)),
+			ContentType: meta.ContentType,
+			SHA256:      hr.sum(),
+			ModTime:     time.Now(),
+		},
+		data: data,
+	}
+	m.mu.Lock()
+	m.objects[key] = mo
+	m.mu.Unlock()
+	obj := mo.obj
+	return &obj, nil
+}
+
+func (m *Memory) get(key string) (*memObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mo, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return mo, nil
+}
+
+func (m *Memory) Open(key string) (io.ReadCloser, *Object, error) {
+	mo, err := m.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj := mo.obj
+	return ioutil.NopCloser(bytes.NewReader(mo.data)), &obj, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[key]; !ok {
+		return ErrNotExist
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) Stat(key string) (*Object, error) {
+	mo, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	obj := mo.obj
+	return &obj, nil
+}
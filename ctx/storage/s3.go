@@ -0,0 +1,280 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is signed when the checksum is unknown before the put.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// emptySHA256 the checksum of the empty payload of GET, HEAD and DELETE.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 stores the objects in the bucket of a S3 compatible service, the
+// requests are path style and signed with the AWS signature v4.
+type S3 struct {
+	// Endpoint the url of the service, e.g. "https://s3.us-east-1.amazonaws.com"
+	// or "http://127.0.0.1:9000" of a MinIO.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Client default http.DefaultClient.
+	Client *http.Client
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *S3) url(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", ErrKey
+	}
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + escapePath(key), nil
+}
+
+// escapePath escape the key segments as the AWS uri encoding.
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(seg), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *S3) do(method, key string, body io.Reader, size int64, payload string, header http.Header) (*http.Response, error) {
+	u, err := s.url(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payload, time.Now().UTC())
+	rsp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		rsp.Body.Close()
+		return nil, ErrNotExist
+	case rsp.StatusCode/100 != 2:
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<10))
+		rsp.Body.Close()
+		if strings.Contains(string(msg), "XAmzContentSHA256Mismatch") || strings.Contains(string(msg), "BadDigest") {
+			return nil, ErrChecksum
+		}
+		return nil, fmt.Errorf("storage: s3 %s %s: %s %s", method, key, rsp.Status, msg)
+	}
+	return rsp, nil
+}
+
+// sign add the AWS signature v4 of the request.
+func (s *S3) sign(req *http.Request, payload string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	names := []string{"host"}
+	canonical := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || lk == "content-md5" || strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			canonical[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put upload the object, the known checksum is signed as the payload
+// hash so the service rejects the corrupted content, and the body of
+// other than the size is cut short so the service never stores it. the
+// existing object is kept on failure. the size is required by the
+// service, the content of the unknown size is buffered.
+func (s *S3) Put(key string, r io.Reader, meta Meta) (*Object, error) {
+	payload := meta.SHA256
+	size := meta.Size
+	if size <= 0 {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+		if payload == "" {
+			payload = hexSHA256(b)
+		}
+	}
+	if payload == "" {
+		payload = unsignedPayload
+	}
+	header := http.Header{}
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	hr := newHashReader(r)
+	sr := &sizedReader{r: hr, left: size}
+	// the checksum is kept as the user metadata for Stat.
+	if meta.SHA256 != "" {
+		header.Set("X-Amz-Meta-Sha256", meta.SHA256)
+	}
+	rsp, err := s.do(http.MethodPut, key, sr, size, payload, header)
+	if sr.err != nil {
+		if rsp != nil {
+			rsp.Body.Close()
+		}
+		return nil, sr.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return &Object{
+		Key:         key,
+		Size:        hr.n,
+		ContentType: meta.ContentType,
+		SHA256:      hr.sum(),
+		ModTime:     time.Now(),
+	}, nil
+}
+
+// sizedReader fails the body of other than left bytes before it is
+// complete, the last byte is held back until the end of the content is
+// known, so the service sees the short body and stores nothing.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (sr *sizedReader) Read(p []byte) (int, error) {
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	if sr.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > sr.left {
+		p = p[:sr.left]
+	}
+	n, err := sr.r.Read(p)
+	sr.left -= int64(n)
+	if sr.left == 0 {
+		var extra [1]byte
+		if m, _ := io.ReadFull(sr.r, extra[:]); m > 0 {
+			sr.err = ErrChecksum
+			return n - 1, sr.err
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		sr.err = ErrChecksum
+		return n, sr.err
+	}
+	return n, err
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, *Object, error) {
+	rsp, err := s.do(http.MethodGet, key, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rsp.Body, s.object(key, rsp), nil
+}
+
+func (s *S3) Delete(key string) error {
+	rsp, err := s.do(http.MethodDelete, key, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s *S3) Stat(key string) (*Object, error) {
+	rsp, err := s.do(http.MethodHead, key, nil, 0, emptySHA256, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+	return s.object(key, rsp), nil
+}
+
+func (s *S3) object(key string, rsp *http.Response) *Object {
+	obj := &Object{
+		Key:         key,
+		Size:        rsp.ContentLength,
+		ContentType: rsp.Header.Get("Content-Type"),
+		SHA256:      rsp.Header.Get("X-Amz-Meta-Sha256"),
+	}
+	if n, err := strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64); err == nil {
+		obj.Size = n
+	}
+	obj.ModTime, _ = http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return obj
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package storage is the backends the uploaded files are saved to.
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotExist = errors.New("storage: object not exist")
+	ErrChecksum = errors.New("storage: checksum mismatch")
+	ErrKey      = errors.New("storage: invalid key")
+)
+
+// Meta describes the object to put.
+type Meta struct {
+	ContentType string
+	// Size of the content, 0 when it is unknown, the empty content is
+	// verified by the SHA256 only.
+	Size int64
+	// SHA256 the hex checksum the content must match, the object is not
+	// committed on mismatch. empty skips the verification.
+	SHA256 string
+}
+
+// Object is the stored object.
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+	// SHA256 the hex checksum, empty when the backend does not keep it.
+	SHA256  string
+	ModTime time.Time
+}
+
+// Storage is the backend of the objects, it must be safe for concurrent use.
+type Storage interface {
+	// Put store the content to the key, the existing object is replaced.
+	Put(key string, r io.Reader, meta Meta) (*Object, error)
+	// Open return the content of the key, ErrNotExist when it is absent.
+	Open(key string) (io.ReadCloser, *Object, error)
+	Delete(key string) error
+	Stat(key string) (*Object, error)
+}
+
+// hashReader computes the checksum of the content read.
+type hashReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{r: r, h: sha256.New()}
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+func (hr *hashReader) sum() string {
+	return hex.EncodeToString(hr.h.Sum(nil))
+}
+
+// verify check the checksum and the size read against the meta.
+func (hr *hashReader) verify(meta Meta) error {
+	if meta.SHA256 != "" && hr.sum() != meta.SHA256 {
+		return ErrChecksum
+	}
+	if meta.Size > 0 && meta.Size != hr.n {
+		return ErrChecksum
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is the stand-in of a S3 compatible service, it checks the
+// signature headers and the payload checksum.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AK/") ||
+		!strings.Contains(auth, "/us-east-1/s3/aws4_request") ||
+		!strings.Contains(auth, "host;x-amz-content-sha256;x-amz-date") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		// the body short of the content length is never stored.
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(body)
+		if payload := r.Header.Get("X-Amz-Content-Sha256"); payload != unsignedPayload && payload != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("<Error><Code>XAmzContentSHA256Mismatch</Code></Error>"))
+			return
+		}
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.headers[key].Get("Content-Type"))
+		w.Header().Set("X-Amz-Meta-Sha256", f.headers[key].Get("X-Amz-Meta-Sha256"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	case http.MethodDelete:
+		if _, ok := f.objects[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func checksum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func testStorage(t *testing.T, s Storage) {
+	const content = "hello storage"
+	obj, err := s.Put("a/b c.txt", strings.NewReader(content), Meta{ContentType: "text/plain", Size: int64(len(content)), SHA256: checksum(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Size != int64(len(content)) || obj.SHA256 != checksum(content) {
+		t.Fatalf("put %+v", obj)
+	}
+	if obj, err = s.Stat("a/b c.txt"); err != nil || obj.Size != int64(len(content)) {
+		t.Fatalf("stat %+v %v", obj, err)
+	}
+	r, obj, err := s.Open("a/b c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != content || obj.ContentType != "text/plain; charset=utf-8" && obj.ContentType != "text/plain" {
+		t.Fatalf("open %q %+v", b, obj)
+	}
+
+	// the corrupted put keeps the existing object.
+	_, err = s.Put("a/b c.txt", strings.NewReader("corrupted"), Meta{Size: 9, SHA256: checksum(content)})
+	if err != ErrChecksum {
+		t.Fatalf("corrupted put: %v", err)
+	}
+	if obj, err = s.Stat("a/b c.txt"); err != nil || obj.Size != int64(len(content)) {
+		t.Fatalf("after corrupted put %+v %v", obj, err)
+	}
+	for _, size := range []int64{5, 20} {
+		if _, err = s.Put("a/b c.txt", strings.NewReader("truncated"), Meta{Size: size}); err != ErrChecksum {
+			t.Fatalf("put of 9 bytes declared %d: %v", size, err)
+		}
+	}
+	if r, obj, err = s.Open("a/b c.txt"); err != nil {
+		t.Fatalf("after put of the wrong size %v", err)
+	}
+	b, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != content {
+		t.Fatalf("after put of the wrong size %q", b)
+	}
+
+	// the size left unknown is not verified, the empty content is put.
+	for _, c := range []string{"unsized", ""} {
+		obj, err := s.Put("unsized", strings.NewReader(c), Meta{SHA256: checksum(c)})
+		if err != nil || obj.Size != int64(len(c)) {
+			t.Fatalf("put %q without the size: %+v %v", c, obj, err)
+		}
+	}
+	if err := s.Delete("unsized"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete("a/b c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a/b c.txt"); err != ErrNotExist {
+		t.Fatalf("stat deleted: %v", err)
+	}
+	if _, _, err := s.Open("missing"); err != ErrNotExist {
+		t.Fatalf("open missing: %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory())
+}
+
+func TestLocal(t *testing.T) {
+	root := t.TempDir()
+	l, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, l)
+	p, _ := l.path("../../etc/passwd")
+	if !strings.HasPrefix(p, root) {
+		t.Fatalf("key escapes the root: %s", p)
+	}
+}
+
+func TestS3(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}})
+	defer srv.Close()
+	testStorage(t, &S3{Endpoint: srv.URL, Bucket: "bucket", Region: "us-east-1", AccessKey: "AK", SecretKey: "SK"})
+}
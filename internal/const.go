@@ -21,6 +21,7 @@ const (
 	MIMEMSGPACK           = "application/x-msgpack"
 	MIMEMSGPACK2          = "application/msgpack"
 	MIMEYAML              = "application/x-yaml"
+	MIMEJavaScript        = "application/javascript"
 
 	MethodGet     = "GET"
 	MethodHead    = "HEAD"
@@ -0,0 +1,129 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parse the cidr list, a bare ip is taken as a single host.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ContainsIP report whether one of the nets contains the ip.
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP return the ip of the host:port address.
+func RemoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		host = strings.TrimSpace(addr)
+	}
+	return net.ParseIP(host)
+}
+
+// ClientIP resolve the client ip of the request. the forwarding headers
+// are only honoured when the peer is one of the trusted proxies, the
+// Forwarded or else the X-Forwarded-For chain is walked from right to
+// left and the first address which is not a trusted proxy is the client.
+func ClientIP(remote net.IP, header http.Header, trusted []*net.IPNet) net.IP {
+	if !ContainsIP(trusted, remote) {
+		return remote
+	}
+	hops := forwardedFor(header.Values("Forwarded"))
+	if len(hops) == 0 {
+		if xff := header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops = strings.Split(strings.Join(xff, ","), ",")
+		}
+	}
+	// the leftmost hop is the client when every hop is trusted.
+	var leftmost net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			leftmost = nil
+			break
+		}
+		if !ContainsIP(trusted, ip) {
+			return ip
+		}
+		leftmost = ip
+	}
+	if leftmost != nil {
+		return leftmost
+	}
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+// forwardedFor return the hosts of the "for" parameters of the RFC 7239
+// Forwarded header, e.g. `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				hops = append(hops, forwardedHost(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedHost strip the brackets and the port of the node.
+func forwardedHost(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.Index(node, ":")]
+	}
+	return node
+}
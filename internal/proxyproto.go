@@ -0,0 +1,138 @@
+// Copyright 2021 XinRui Hua.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrProxyIncomplete = errors.New("proxy header incomplete")
+	ErrProxyHeader     = errors.New("invalid proxy header")
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLen the max length of the v1 header including the CRLF.
+const proxyV1MaxLen = 107
+
+// ParseProxyHeader parse the HAProxy PROXY protocol v1 or v2 header at
+// the head of b, return the source address and the header length.
+// ErrProxyIncomplete is returned until the whole header is buffered.
+// the source is nil for the v1 UNKNOWN protocol and the v2 LOCAL
+// command, the connection address is kept for them.
+func ParseProxyHeader(b []byte) (net.Addr, int, error) {
+	if len(b) == 0 {
+		return nil, 0, ErrProxyIncomplete
+	}
+	if b[0] == proxyV2Sig[0] {
+		return parseProxyV2(b)
+	}
+	return parseProxyV1(b)
+}
+
+// ProxyV2Len return the length of the v2 header declared by its 16 bytes
+// prefix at the head of b, 0 if b doesn't hold the prefix of a v2 header.
+func ProxyV2Len(b []byte) int {
+	if len(b) < 16 || !bytes.Equal(b[:len(proxyV2Sig)], proxyV2Sig) || b[12]>>4 != 2 {
+		return 0
+	}
+	return 16 + int(binary.BigEndian.Uint16(b[14:16]))
+}
+
+func parseProxyV1(b []byte) (net.Addr, int, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		n := len(b)
+		if n > len(proxyV1Prefix) {
+			n = len(proxyV1Prefix)
+		}
+		if !bytes.Equal(b[:n], proxyV1Prefix[:n]) || len(b) >= proxyV1MaxLen {
+			return nil, 0, ErrProxyHeader
+		}
+		return nil, 0, ErrProxyIncomplete
+	}
+	if end+2 > proxyV1MaxLen || !bytes.HasPrefix(b, proxyV1Prefix) {
+		return nil, 0, ErrProxyHeader
+	}
+	fields := strings.Split(string(b[len(proxyV1Prefix):end]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, end + 2, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, 0, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[1])
+	if ip == nil || net.ParseIP(fields[2]) == nil || (ip.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, 0, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, 0, ErrProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+		return nil, 0, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, end + 2, nil
+}
+
+func parseProxyV2(b []byte) (net.Addr, int, error) {
+	n := len(b)
+	if n > len(proxyV2Sig) {
+		n = len(proxyV2Sig)
+	}
+	if !bytes.Equal(b[:n], proxyV2Sig[:n]) {
+		return nil, 0, ErrProxyHeader
+	}
+	if len(b) < 16 {
+		return nil, 0, ErrProxyIncomplete
+	}
+	verCmd, family := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, ErrProxyHeader
+	}
+	size := 16 + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < size {
+		return nil, 0, ErrProxyIncomplete
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL, the health check of the proxy itself.
+		return nil, size, nil
+	case 1:
+	default:
+		return nil, 0, ErrProxyHeader
+	}
+
+	addr := b[16:size]
+	switch family >> 4 {
+	case 1:
+		if len(addr) < 12 {
+			return nil, 0, ErrProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), addr[:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addr[8:10]))}, size, nil
+	case 2:
+		if len(addr) < 36 {
+			return nil, 0, ErrProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), addr[:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addr[32:34]))}, size, nil
+	}
+	// AF_UNSPEC and AF_UNIX carry no ip address.
+	return nil, size, nil
+}
@@ -60,8 +60,14 @@ func debugLine() {
 	// 1. func name
 	_, file, line, ok := runtime.Caller(2)
 	if ok {
-		path := strings.Split(file, "/rx/")[1] + fmt.Sprintf(":%d", line) + "\n"
-		fmt.Fprint(reqWriter, path)
+		// the path relative to the module, the module cache dir is
+		// "rx@version".
+		if i := strings.LastIndex(file, "/rx"); i >= 0 {
+			if j := strings.Index(file[i+1:], "/"); j >= 0 {
+				file = file[i+1+j+1:]
+			}
+		}
+		fmt.Fprint(reqWriter, file+fmt.Sprintf(":%d", line)+"\n")
 	}
 }
 